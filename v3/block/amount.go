@@ -0,0 +1,90 @@
+package block
+
+import (
+    "fmt"
+    "math"
+    "strings"
+)
+
+// 金额使用 int64 表示，单位为聪（satoshi），1 个币等于 1 亿聪
+// 避免 float64 在找零和求和时产生精度误差
+
+// 1 个币对应的聪数
+const SatoshiPerCoin = 100000000
+
+// 小数位数
+const amountDecimals = 8
+
+// 金额上限，超过时认为金额无效
+const MaxAmount = 21000000 * SatoshiPerCoin
+
+// 将金额格式化为小数字符串，例如 1250000000 => 12.50000000
+func FormatAmount(amount int64) string {
+    sign := ""
+    // math.MinInt64 取反会溢出，使用 uint64 计算
+    value := uint64(amount)
+    if amount < 0 {
+        sign = "-"
+        value = uint64(-(amount + 1)) + 1
+    }
+    return fmt.Sprintf("%s%d.%08d", sign, value/SatoshiPerCoin, value%SatoshiPerCoin)
+}
+
+// 将小数字符串解析为金额，最多 8 位小数，例如 12.5 => 1250000000
+func ParseAmount(str string) (int64, error) {
+    str = strings.TrimSpace(str)
+    if str == "" {
+        return 0, fmt.Errorf("金额为空")
+    }
+    if strings.HasPrefix(str, "-") {
+        return 0, fmt.Errorf("金额 %s 不能为负数", str)
+    }
+
+    intPart := str
+    fracPart := ""
+    if i := strings.Index(str, "."); i >= 0 {
+        intPart = str[:i]
+        fracPart = str[i+1:]
+    }
+    if intPart == "" && fracPart == "" {
+        return 0, fmt.Errorf("金额 %s 格式错误", str)
+    }
+    if len(fracPart) > amountDecimals {
+        return 0, fmt.Errorf("金额 %s 最多 %d 位小数", str, amountDecimals)
+    }
+    // 补齐 8 位小数
+    fracPart += strings.Repeat("0", amountDecimals-len(fracPart))
+
+    var amount int64
+    for _, c := range intPart + fracPart {
+        if c < '0' || c > '9' {
+            return 0, fmt.Errorf("金额 %s 格式错误", str)
+        }
+        if amount > (math.MaxInt64-int64(c-'0'))/10 {
+            return 0, fmt.Errorf("金额 %s 溢出", str)
+        }
+        amount = amount*10 + int64(c-'0')
+    }
+    if amount > MaxAmount {
+        return 0, fmt.Errorf("金额 %s 超过上限 %s", str, FormatAmount(MaxAmount))
+    }
+    return amount, nil
+}
+
+// 判断金额是否有效
+func IsValidAmount(amount int64) bool {
+    return amount >= 0 && amount <= MaxAmount
+}
+
+// 金额相加，溢出或超过上限时返回错误
+func AddAmount(a, b int64) (int64, error) {
+    if !IsValidAmount(a) || !IsValidAmount(b) {
+        return 0, fmt.Errorf("无效的金额 %d, %d", a, b)
+    }
+    // 两个金额都不超过上限，相加不会溢出 int64
+    sum := a + b
+    if sum > MaxAmount {
+        return 0, fmt.Errorf("金额 %s 超过上限 %s", FormatAmount(sum), FormatAmount(MaxAmount))
+    }
+    return sum, nil
+}
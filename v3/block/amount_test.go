@@ -0,0 +1,91 @@
+package block
+
+import (
+    "math"
+    "testing"
+)
+
+func TestParseAmount(t *testing.T) {
+    tests := []struct {
+        str     string
+        want    int64
+        wantErr bool
+    }{
+        {"1", SatoshiPerCoin, false},
+        {"0", 0, false},
+        {"12.5", 1250000000, false},
+        {" 0.00000001 ", 1, false},
+        {".5", 50000000, false},
+        {"5.", 500000000, false},
+        {"21000000", MaxAmount, false},
+        {"20999999.99999999", MaxAmount - 1, false},
+        {"", 0, true},
+        {".", 0, true},
+        {"-1", 0, true},
+        {"1.000000001", 0, true},
+        {"1.2.3", 0, true},
+        {"1e8", 0, true},
+        {"+1", 0, true},
+        {"21000000.00000001", 0, true},
+        {"99999999999999999999", 0, true},
+    }
+    for _, test := range tests {
+        amount, err := ParseAmount(test.str)
+        if (err != nil) != test.wantErr {
+            t.Errorf("ParseAmount(%q) err = %v, wantErr %v", test.str, err, test.wantErr)
+            continue
+        }
+        if err == nil && amount != test.want {
+            t.Errorf("ParseAmount(%q) = %d, want %d", test.str, amount, test.want)
+        }
+    }
+}
+
+func TestFormatAmount(t *testing.T) {
+    tests := []struct {
+        amount int64
+        want   string
+    }{
+        {0, "0.00000000"},
+        {1, "0.00000001"},
+        {SatoshiPerCoin, "1.00000000"},
+        {1250000000, "12.50000000"},
+        {MaxAmount, "21000000.00000000"},
+        {-1, "-0.00000001"},
+        {math.MinInt64, "-92233720368.54775808"},
+    }
+    for _, test := range tests {
+        str := FormatAmount(test.amount)
+        if str != test.want {
+            t.Errorf("FormatAmount(%d) = %s, want %s", test.amount, str, test.want)
+        }
+        // 有效的金额格式化后可以解析回原来的值
+        if !IsValidAmount(test.amount) {
+            continue
+        }
+        amount, err := ParseAmount(str)
+        if err != nil || amount != test.amount {
+            t.Errorf("ParseAmount(%s) = %d, %v, want %d", str, amount, err, test.amount)
+        }
+    }
+}
+
+func TestAddAmount(t *testing.T) {
+    tests := []struct {
+        a, b    int64
+        want    int64
+        wantErr bool
+    }{
+        {1, 2, 3, false},
+        {MaxAmount - 1, 1, MaxAmount, false},
+        {MaxAmount, 1, 0, true},
+        {-1, 1, 0, true},
+        {math.MaxInt64, 1, 0, true},
+    }
+    for _, test := range tests {
+        sum, err := AddAmount(test.a, test.b)
+        if (err != nil) != test.wantErr || (err == nil && sum != test.want) {
+            t.Errorf("AddAmount(%d, %d) = %d, %v, want %d, wantErr %v", test.a, test.b, sum, err, test.want, test.wantErr)
+        }
+    }
+}
@@ -2,9 +2,9 @@ package block
 
 import (
     "bytes"
-    "crypto/sha256"
     "encoding/gob"
     "log"
+    "math/big"
     "time"
 )
 
@@ -19,16 +19,24 @@ type Block struct {
     // Data       []byte // 数据，后续使用交易替代
     Transactions []*Transaction
     Hash         []byte // 当前区块 hash
+    Height       uint64   // 区块高度，不参与区块头 hash 的计算
+    ChainWork    *big.Int // 从创世块到当前区块的累计工作量，不参与区块头 hash 的计算
 }
 
 // 创建区块函数
-func NewBlock(txs []*Transaction, prevHash []byte) *Block {
+// difficulty 为压缩格式的难度值
+func NewBlock(txs []*Transaction, prevHash []byte, difficulty uint64) *Block {
+    return NewBlockWithTimestamp(txs, prevHash, difficulty, uint64(time.Now().Unix()))
+}
+
+// 使用指定的时间戳创建区块
+func NewBlockWithTimestamp(txs []*Transaction, prevHash []byte, difficulty uint64, timestamp uint64) *Block {
     block := Block{
         Version:    00,
         PrevHash:   prevHash,
         MerKleRoot: []byte{}, // 先填写空
-        Timestamp:  uint64(time.Now().Unix()),
-        Difficulty: Bits,
+        Timestamp:  timestamp,
+        Difficulty: difficulty,
         Nonce:      0,
         Hash:       []byte{}, // 先填充为空
         // Data:       []byte(data),
@@ -66,15 +74,29 @@ func (block *Block) ToBlock(data []byte) {
     }
 }
 
-// 模拟梅特尔根
+// 梅特尔根
+// 使用交易 id 构建梅克尔树，树的根节点作为梅特尔根
 func (block *Block) HashTransactions() {
-    // 将交易 id 拼接，做一次 hash 运算作为梅特尔根
-    var txIds []byte
+    block.MerKleRoot = block.MerkleTree().Root()
+}
+
+// 使用区块中的交易构建梅克尔树
+func (block *Block) MerkleTree() *MerkleTree {
+    var txIds [][]byte
     for _, tx := range block.Transactions {
-        txIds = append(txIds, tx.TxId...)
+        txIds = append(txIds, tx.TxId)
+    }
+    return NewMerkleTree(txIds)
+}
+
+// 生成交易的梅克尔证明，交易不在区块中时返回 nil
+func (block *Block) MerkleProof(txId []byte) *MerkleProof {
+    for i, tx := range block.Transactions {
+        if bytes.Equal(tx.TxId, txId) {
+            return block.MerkleTree().Proof(i)
+        }
     }
-    hash := sha256.Sum256(txIds)
-    block.MerKleRoot = hash[:]
+    return nil
 }
 
 // 计算当前区块 hash
@@ -2,11 +2,14 @@ package block
 
 import (
     "bytes"
-    "crypto/ecdsa"
     "fmt"
     "github.com/boltdb/bolt"
+    "github.com/decred/dcrd/dcrec/secp256k1/v4"
     "log"
     "os"
+    "sort"
+    "strings"
+    "time"
 )
 
 const firstData = "Go 区块链"
@@ -38,15 +41,52 @@ const DBPath = "block_bolt.db"
 const LastHashKey = "last_block_hash"
 const BucketName = "block_bucket"
 
+// 节点 id，同一台机器上运行多个节点时，使用不同的 id 区分数据库和钱包文件
+const NodeIdEnv = "NODE_ID"
+
+// 获取节点 id
+func GetNodeId() string {
+    return os.Getenv(NodeIdEnv)
+}
+
+// 获取数据库路径
+// 设置了节点 id 时，使用 block_bolt_<id>.db
+func dbPath() string {
+    nodeId := GetNodeId()
+    if nodeId == "" {
+        return DBPath
+    }
+    return strings.TrimSuffix(DBPath, ".db") + "_" + nodeId + ".db"
+}
+
 // 区块链结构体
 type BlockChain struct {
     boltDB        *bolt.DB // bolt 数据库句柄
-    lastBlockHash []byte   // 最后一个区块的 hash
+    lastBlockHash []byte       // 最后一个区块的 hash
+    params        *ChainParams // 链参数
+    tx            *bolt.Tx     // 正在进行的写事务，不为空时读取数据使用该事务，可以读到未提交的修改
+}
+
+// 在只读事务中读取数据，存在正在进行的写事务时使用写事务
+func (blockChain *BlockChain) view(fn func(tx *bolt.Tx) error) error {
+    if blockChain.tx != nil {
+        return fn(blockChain.tx)
+    }
+    return blockChain.boltDB.View(fn)
 }
 
 // 创建区块链函数
-func NewBlockChain(miner string) *BlockChain {
-    db, err := bolt.Open(DBPath, 0600, nil)
+// params 为链参数，保存在数据库中
+func NewBlockChain(miner string, params *ChainParams) *BlockChain {
+    // 创世块只有挖矿交易
+    coinBase := NewCoinBaseTx(miner, firstData, BlockSubsidy(params, 0))
+    genesis := NewBlock([]*Transaction{coinBase}, []byte{0x0000000000000000}, InitialDifficulty)
+    return createBlockChain(dbPath(), genesis, params)
+}
+
+// 在 path 创建数据库，存入创世块
+func createBlockChain(path string, genesis *Block, params *ChainParams) *BlockChain {
+    db, err := bolt.Open(path, 0600, nil)
     if err != nil {
         log.Fatal(err)
     }
@@ -63,10 +103,27 @@ func NewBlockChain(miner string) *BlockChain {
                 log.Fatal(err)
             }
         }
+        // 创建 UTXO 集合
+        _, err = tx.CreateBucketIfNotExists([]byte(UTXOBucketName))
+        if err != nil {
+            log.Fatal(err)
+        }
+        // 创建区块高度索引和交易索引
+        _, err = tx.CreateBucketIfNotExists([]byte(HeightBucketName))
+        if err != nil {
+            log.Fatal(err)
+        }
+        _, err = tx.CreateBucketIfNotExists([]byte(TxIndexBucketName))
+        if err != nil {
+            log.Fatal(err)
+        }
         return nil
     })
 
-    var lastBlockHash []byte
+    blockChain := BlockChain{
+        boltDB: db,
+        params: params,
+    }
 
     // 存入数据
     db.Update(func(tx *bolt.Tx) error {
@@ -75,34 +132,42 @@ func NewBlockChain(miner string) *BlockChain {
         if bucket.Get([]byte(LastHashKey)) != nil {
             log.Fatal("区块链已存在!")
         }
+        // 金额单位为聪
+        err := bucket.Put([]byte(AmountUnitKey), []byte(AmountUnitSatoshi))
+        if err != nil {
+            return err
+        }
+        err = bucket.Put([]byte(UTXOVersionKey), []byte(UTXOVersion))
+        if err != nil {
+            return err
+        }
+        err = bucket.Put([]byte(ChainParamsKey), params.ToBytes())
+        if err != nil {
+            return err
+        }
 
         // 添加创世块
-        // 创世块只有挖矿交易
-        coinBase := NewCoinBaseTx(miner, firstData)
-        block := NewBlock([]*Transaction{coinBase}, []byte{0x0000000000000000})
-        err := bucket.Put(block.Hash, block.ToBytes())
-        // 存入最后一个区块 hash
-        err = bucket.Put([]byte(LastHashKey), block.Hash)
-
-        lastBlockHash = block.Hash
-        return err
+        return blockChain.connectBlock(tx, genesis)
     })
 
-    blockChain := BlockChain{
-        boltDB:        db,
-        lastBlockHash: lastBlockHash,
-    }
     return &blockChain
 }
 
 // 获取区块链函数
 func GetBlockChain() *BlockChain {
-    db, err := bolt.Open(DBPath, 0600, nil)
+    db, err := bolt.Open(dbPath(), 0600, nil)
     if err != nil {
         log.Fatal(err)
     }
 
+    // 旧版本的金额格式需要先迁移
+    checkAmountUnit(db)
+
     var lastBlockHash []byte
+    var params *ChainParams
+    var reindexUTXO bool
+    var reindexHeight bool
+    var hasTxIndex bool
 
     // 获取数据
     db.View(func(tx *bolt.Tx) error {
@@ -111,19 +176,142 @@ func GetBlockChain() *BlockChain {
         if bucket == nil {
             log.Fatal("区块链不存在")
         }
-        lastBlockHash = bucket.Get([]byte(LastHashKey))
+        // bolt 返回的数据只在事务中有效，需要复制
+        lastBlockHash = copyBytes(bucket.Get([]byte(LastHashKey)))
+        params = loadChainParams(bucket)
+        reindexUTXO = needReindexUTXO(tx)
+        reindexHeight = needReindexHeight(tx)
+        hasTxIndex = tx.Bucket([]byte(TxIndexBucketName)) != nil
         return nil
     })
 
     blockChain := BlockChain{
         boltDB:        db,
         lastBlockHash: lastBlockHash,
+        params:        params,
+    }
+
+    // 旧版本的数据库没有区块高度和累计工作量，重建高度索引
+    if reindexHeight {
+        blockChain.ReindexHeight()
+    }
+    // 旧版本的数据库没有交易索引，重建交易索引
+    if !hasTxIndex {
+        blockChain.ReindexTransactions()
+    }
+    // 旧版本的数据库没有 UTXO 集合或 UTXO 没有区块高度，从账本中重建，需要在区块高度之后
+    if reindexUTXO {
+        blockChain.ReindexUTXO()
+    }
+    return &blockChain
+}
+
+// 只读打开数据库时等待文件锁的时间
+const ReadOnlyTimeout = 3 * time.Second
+
+// 只读打开区块链函数
+// 与运行中的节点共享数据库，不迁移数据也不重建索引
+// bolt 的写锁是排他的，节点运行时等待 ReadOnlyTimeout 后返回错误，而不是一直阻塞
+func GetBlockChainReadOnly() (*BlockChain, error) {
+    db, err := bolt.Open(dbPath(), 0600, &bolt.Options{ReadOnly: true, Timeout: ReadOnlyTimeout})
+    if err == bolt.ErrTimeout {
+        return nil, fmt.Errorf("数据库 %s 被占用, 请先停止运行中的节点", dbPath())
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var lastBlockHash []byte
+    var params *ChainParams
+    err = db.View(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket([]byte(BucketName))
+        if bucket == nil {
+            return fmt.Errorf("区块链不存在")
+        }
+        lastBlockHash = copyBytes(bucket.Get([]byte(LastHashKey)))
+        params = loadChainParams(bucket)
+        return nil
+    })
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return &BlockChain{
+        boltDB:        db,
+        lastBlockHash: lastBlockHash,
+        params:        params,
+    }, nil
+}
+
+// 打开区块链函数
+// 数据库不存在时创建一个没有区块的区块链，用于节点从其他节点同步区块
+// 没有区块时保存链参数 params，已有区块时使用数据库中的链参数
+func OpenBlockChain(params *ChainParams) *BlockChain {
+    db, err := bolt.Open(dbPath(), 0600, nil)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    checkAmountUnit(db)
+
+    var lastBlockHash []byte
+    var reindexUTXO bool
+    var reindexHeight bool
+    var hasTxIndex bool
+
+    err = db.Update(func(tx *bolt.Tx) error {
+        bucket, err := tx.CreateBucketIfNotExists([]byte(BucketName))
+        if err != nil {
+            return err
+        }
+        err = bucket.Put([]byte(AmountUnitKey), []byte(AmountUnitSatoshi))
+        if err != nil {
+            return err
+        }
+        _, err = tx.CreateBucketIfNotExists([]byte(UTXOBucketName))
+        if err != nil {
+            return err
+        }
+        reindexHeight = needReindexHeight(tx)
+        hasTxIndex = tx.Bucket([]byte(TxIndexBucketName)) != nil
+        // bolt 返回的数据只在事务中有效，需要复制
+        lastBlockHash = copyBytes(bucket.Get([]byte(LastHashKey)))
+        // 没有区块时直接使用新版本的 UTXO 集合
+        if lastBlockHash == nil {
+            err = bucket.Put([]byte(ChainParamsKey), params.ToBytes())
+            if err != nil {
+                return err
+            }
+            return bucket.Put([]byte(UTXOVersionKey), []byte(UTXOVersion))
+        }
+        params = loadChainParams(bucket)
+        reindexUTXO = needReindexUTXO(tx)
+        return nil
+    })
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    blockChain := BlockChain{
+        boltDB:        db,
+        lastBlockHash: lastBlockHash,
+        params:        params,
+    }
+    if reindexHeight {
+        blockChain.ReindexHeight()
+    }
+    if !hasTxIndex {
+        blockChain.ReindexTransactions()
+    }
+    if reindexUTXO {
+        blockChain.ReindexUTXO()
     }
     return &blockChain
 }
 
 // 添加区块方法
-func (blockChain *BlockChain) AddBlock(txs []*Transaction) {
+// 挖矿在事务之外进行，只在存入区块时打开写事务，避免挖矿期间一直占用数据库的写锁
+func (blockChain *BlockChain) AddBlock(txs []*Transaction) (*Block, error) {
     // 得到交易后第一时间对交易进行校验，过滤调无效交易
     var validTxs []*Transaction
     for _, tx := range txs {
@@ -134,102 +322,430 @@ func (blockChain *BlockChain) AddBlock(txs []*Transaction) {
         }
     }
 
+    // 过滤后重新校验挖矿交易的金额，不能包含被过滤的交易的手续费
+    prevHash := blockChain.lastBlockHash
+    err := blockChain.checkCoinBase(&Block{PrevHash: prevHash, Transactions: validTxs})
+    if err != nil {
+        return nil, err
+    }
+
+    // 按照难度调整规则计算难度值
+    difficulty := blockChain.NextDifficulty(prevHash)
+    timestamp := blockChain.nextTimestamp()
+    block := NewBlockWithTimestamp(validTxs, prevHash, difficulty, timestamp)
+
     // 存入数据
-    blockChain.boltDB.Update(func(tx *bolt.Tx) error {
-        bucket := tx.Bucket([]byte(BucketName))
+    err = blockChain.boltDB.Update(func(tx *bolt.Tx) error {
+        // 挖矿期间最后一个区块可能已经改变
+        if !bytes.Equal(tx.Bucket([]byte(BucketName)).Get([]byte(LastHashKey)), prevHash) {
+            return fmt.Errorf("挖矿期间最后一个区块已改变, 区块 %x 作废", block.Hash)
+        }
+        return blockChain.connectBlock(tx, block)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return block, nil
+}
+
+// 保存其他节点发送的区块
+// 前一个区块可以是任意已知的区块，连接在最后一个区块之后时直接成为主链
+// 连接在其他区块之后时保存为分支，分支的累计工作量超过主链时进行链重组
+// 返回连接到主链上的区块，链重组时为新分支上的所有区块，保存为分支时为空
+func (blockChain *BlockChain) SaveBlock(block *Block) ([]*Block, error) {
+    if blockChain.HasBlock(block.Hash) {
+        return nil, fmt.Errorf("区块 %x 已存在", block.Hash)
+    }
+
+    tip := blockChain.GetBlockByHash(blockChain.lastBlockHash)
+    // 没有区块时只接受创世块
+    if tip == nil && !bytes.Equal(block.PrevHash, []byte{0x0000000000000000}) {
+        return nil, fmt.Errorf("区块 %x 不是创世块", block.Hash)
+    }
+    if tip != nil && !blockChain.HasBlock(block.PrevHash) {
+        return nil, fmt.Errorf("区块 %x 的前一个区块 %x 不存在", block.Hash, block.PrevHash)
+    }
+
+    // 区块中的 hash 由对方提供，需要重新计算，否则可以伪造工作量证明
+    if !bytes.Equal(block.CalculateHash(), block.Hash) {
+        return nil, fmt.Errorf("区块 %x 的 hash 与区块头不一致", block.Hash)
+    }
+    pow := NewProofOfWork(block)
+    if !pow.IsValid(blockChain.NextDifficulty(block.PrevHash)) {
+        return nil, fmt.Errorf("区块 %x 工作量证明无效", block.Hash)
+    }
+    if !bytes.Equal(block.MerKleRoot, block.MerkleTree().Root()) {
+        return nil, fmt.Errorf("区块 %x 梅特尔根无效", block.Hash)
+    }
+
+    // 连接在最后一个区块之后
+    if tip == nil || bytes.Equal(block.PrevHash, tip.Hash) {
+        if err := blockChain.checkBlockTransactions(block); err != nil {
+            return nil, fmt.Errorf("区块 %x 无效: %v", block.Hash, err)
+        }
+        err := blockChain.boltDB.Update(func(tx *bolt.Tx) error {
+            if !bytes.Equal(tx.Bucket([]byte(BucketName)).Get([]byte(LastHashKey)), blockChain.lastBlockHash) {
+                return fmt.Errorf("区块 %x 的前一个区块 %x 不是最后一个区块", block.Hash, block.PrevHash)
+            }
+            return blockChain.connectBlock(tx, block)
+        })
+        if err != nil {
+            return nil, err
+        }
+        return []*Block{block}, nil
+    }
+
+    // 保存为分支
+    err := blockChain.boltDB.Update(func(tx *bolt.Tx) error {
+        return storeBlock(tx.Bucket([]byte(BucketName)), block)
+    })
+    if err != nil {
+        return nil, err
+    }
+    if block.ChainWork.Cmp(tip.ChainWork) <= 0 {
+        fmt.Printf("区块 %x 保存在分支上, 高度 %d\n", block.Hash, block.Height)
+        return nil, nil
+    }
+    return blockChain.reorganize(block)
+}
+
+// 计算时间戳中位数的区块数
+const MedianTimeBlocks = 11
+
+// 区块时间戳最多可以比当前时间晚多少秒
+const MaxFutureBlockTime = 2 * 60 * 60
+
+// 计算 hash 为 prevHash 的区块及之前共 MedianTimeBlocks 个区块的时间戳中位数，没有区块时返回 0
+func (blockChain *BlockChain) MedianTimePast(prevHash []byte) uint64 {
+    var timestamps []uint64
+    for block := blockChain.GetBlockByHash(prevHash) ; block != nil && len(timestamps) < MedianTimeBlocks ; block = blockChain.GetBlockByHash(block.PrevHash) {
+        timestamps = append(timestamps, block.Timestamp)
+    }
+    if len(timestamps) == 0 {
+        return 0
+    }
+    sort.Slice(timestamps, func(i, j int) bool {
+        return timestamps[i] < timestamps[j]
+    })
+    return timestamps[len(timestamps)/2]
+}
+
+// 下一个区块的时间戳，使用当前时间，但必须大于前面区块的时间戳中位数
+func (blockChain *BlockChain) nextTimestamp() uint64 {
+    timestamp := uint64(time.Now().Unix())
+    if medianTime := blockChain.MedianTimePast(blockChain.lastBlockHash); timestamp <= medianTime {
+        timestamp = medianTime + 1
+    }
+    return timestamp
+}
 
-        // 添加区块
-        block := NewBlock(validTxs, blockChain.lastBlockHash)
-        err := bucket.Put(block.Hash, block.ToBytes())
-        // 存入最后一个区块 hash
-        err = bucket.Put([]byte(LastHashKey), block.Hash)
-        blockChain.lastBlockHash = block.Hash
+// 校验区块时间戳
+// 必须大于前面区块的时间戳中位数，并且不能比当前时间晚太多，否则可以伪造时间绕过锁定时间
+func (blockChain *BlockChain) checkTimestamp(block *Block) error {
+    if medianTime := blockChain.MedianTimePast(block.PrevHash); block.Timestamp <= medianTime {
+        return fmt.Errorf("区块时间戳 %d 不大于前面区块的时间戳中位数 %d", block.Timestamp, medianTime)
+    }
+    if maxTime := uint64(time.Now().Unix()) + MaxFutureBlockTime; block.Timestamp > maxTime {
+        return fmt.Errorf("区块时间戳 %d 超过当前时间太多", block.Timestamp)
+    }
+    return nil
+}
+
+// 校验区块中的交易签名、锁定时间和挖矿交易
+// 交易引用的 output 必须在当前主链上，同一个 output 在区块中只能花费一次
+// 区块高度由前一个区块计算，不使用区块中的高度
+func (blockChain *BlockChain) checkBlockTransactions(block *Block) error {
+    err := blockChain.checkTimestamp(block)
+    if err != nil {
+        return err
+    }
+    height := uint64(blockChain.blockHeight(block))
+
+    // 先检查双花，否则重复的 input 会重复计算手续费
+    spent := make(map[string]bool)
+    for _, tx := range block.Transactions {
+        if tx.IsCoinBase() {
+            continue
+        }
+        for _, input := range tx.TxInputs {
+            key := outPointKey(input.TxId, input.Index)
+            if spent[key] {
+                return fmt.Errorf("交易 %x 重复花费 output %s", tx.TxId, key)
+            }
+            spent[key] = true
+        }
+    }
+    for _, tx := range block.Transactions {
+        if !blockChain.VerifyTransaction(tx) {
+            return fmt.Errorf("存在无效的交易 %x", tx.TxId)
+        }
+        if err := blockChain.CheckLockTime(tx, height, block.Timestamp); err != nil {
+            return fmt.Errorf("交易 %x 无效: %v", tx.TxId, err)
+        }
+    }
+    return blockChain.checkCoinBase(block)
+}
+
+// 将区块连接到最后一个区块之后
+// 在同一个事务中存入区块、更新最后一个区块 hash、区块高度索引、交易索引和 UTXO 集合，保证数据一致
+func (blockChain *BlockChain) connectBlock(tx *bolt.Tx, block *Block) error {
+    bucket := tx.Bucket([]byte(BucketName))
+    err := storeBlock(bucket, block)
+    if err != nil {
+        return err
+    }
+    // 更新区块高度索引
+    err = tx.Bucket([]byte(HeightBucketName)).Put(heightToBytes(block.Height), block.Hash)
+    if err != nil {
+        return err
+    }
+    // 更新交易索引
+    err = updateTxIndex(tx.Bucket([]byte(TxIndexBucketName)), block)
+    if err != nil {
+        return err
+    }
+    // 存入最后一个区块 hash
+    err = bucket.Put([]byte(LastHashKey), block.Hash)
+    if err != nil {
+        return err
+    }
+    // 更新 UTXO 集合
+    err = updateUTXOSet(tx.Bucket([]byte(UTXOBucketName)), block)
+    if err != nil {
         return err
+    }
+    blockChain.lastBlockHash = block.Hash
+    return nil
+}
+
+// 复制 bolt 返回的数据，nil 保持为 nil
+func copyBytes(data []byte) []byte {
+    if data == nil {
+        return nil
+    }
+    return append([]byte{}, data...)
+}
+
+// 判断区块是否存在
+func (blockChain *BlockChain) HasBlock(hash []byte) bool {
+    return blockChain.GetBlockByHash(hash) != nil
+}
+
+// 根据 hash 获取区块
+func (blockChain *BlockChain) GetBlockByHash(hash []byte) *Block {
+    var block *Block
+    blockChain.view(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket([]byte(BucketName))
+        value := bucket.Get(hash)
+        if value != nil {
+            block = &Block{}
+            block.ToBlock(value)
+        }
+        return nil
     })
+    return block
+}
+
+// 最后一个区块的 hash
+func (blockChain *BlockChain) LastBlockHash() []byte {
+    return blockChain.lastBlockHash
+}
+
+// 区块链高度，即最后一个区块的高度，创世块高度为 0，没有区块时为 -1
+func (blockChain *BlockChain) Height() int {
+    block := blockChain.GetBlockByHash(blockChain.lastBlockHash)
+    if block == nil {
+        return -1
+    }
+    return int(block.Height)
 }
 
-// 查找 UTXO
-func (blockChain *BlockChain) FindMyUTXOs(publicKeyHash []byte) []UTXOInfo {
-    var UTXOInfos []UTXOInfo
-    // 0x111 => {0, 1}
-    spentUTXOs := make(map[string][]int)
+// 获取 hash 之后的所有区块 hash，按照从创世块到最后一个区块的顺序
+// hash 为 nil 或者不在链上时，返回所有区块 hash
+func (blockChain *BlockChain) GetBlockHashesAfter(hash []byte) [][]byte {
+    var hashes [][]byte
     it := blockChain.Iterator()
-    // 遍历区块
     for block := it.Next() ; block != nil ; block = it.Next() {
-        // 遍历交易
-        for _, tx := range block.Transactions {
-            // 挖矿机交易，跳过
-            if tx.IsCoinBase() == false {
-                // 遍历 input
-                for _, input := range tx.TxInputs {
-                    if bytes.Equal(HashPublicKey(input.PublicKey), publicKeyHash) {
-                        key := string(input.TxId)
-                        // 保存输入脚本对应输出脚本的 index，使用 txID 作为 key
-                        spentUTXOs[key] = append(spentUTXOs[key], input.Index)
-                    }
-                }
-            }
-
-            // 遍历 output
-        OUTPUT:
-            for i, output := range tx.TxOutputs {
-                // 过滤 消耗的 output
-                key := string(tx.TxId)
-                indexes := spentUTXOs[key]
-                if len(indexes) > 0 {
-                    for _, j := range indexes {
-                        if j == i {
-                            // 忽略
-                            continue OUTPUT
-                        }
-                    }
-                }
-
-                // 查找属于 address 的 output
-                if bytes.Equal(output.PublicKeyHash, publicKeyHash) {
-                    UTXOInfo := UTXOInfo{tx.TxId, i, output}
-                    UTXOInfos = append(UTXOInfos, UTXOInfo)
-                }
-            }
+        if bytes.Equal(block.Hash, hash) {
+            break
         }
+        hashes = append(hashes, block.Hash)
+    }
+    // 反转顺序
+    for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+        hashes[i], hashes[j] = hashes[j], hashes[i]
     }
-    return UTXOInfos
+    return hashes
 }
 
 // 获取余额
 func (blockChain *BlockChain) GetBalance(address string) {
+    balance, immature := blockChain.Balance(address)
+    fmt.Printf("%s的余额为%s", address, FormatAmount(balance))
+    if immature > 0 {
+        fmt.Printf(", 未成熟的挖矿奖励为%s", FormatAmount(immature))
+    }
+}
+
+// 获取地址的余额
+// 返回可以花费的余额和未成熟的挖矿奖励
+func (blockChain *BlockChain) Balance(address string) (int64, int64) {
     publicKeyHash := Lock(address)
     UTXOInfos := blockChain.FindMyUTXOs(publicKeyHash)
-    total := 0.0
+    height := uint64(blockChain.Height() + 1)
+    var total int64
+    var immature int64
     for _, UTXOInfo := range UTXOInfos {
+        if !UTXOInfo.IsMature(height) {
+            immature += UTXOInfo.Output.Value
+            continue
+        }
         total += UTXOInfo.Output.Value
     }
-    fmt.Printf("%s的余额为%f", address, total)
+    return total, immature
+}
+
+// 计算交易的手续费，即输入金额减去输出金额
+// 输入引用的 output 必须在 UTXO 集合中
+func (blockChain *BlockChain) TransactionFee(tx *Transaction) (int64, error) {
+    if tx.IsCoinBase() {
+        return 0, nil
+    }
+    var inputValue int64
+    for _, input := range tx.TxInputs {
+        output, ok := blockChain.GetUTXO(input.TxId, input.Index)
+        if !ok {
+            return 0, fmt.Errorf("output %s 不存在或已被花费", outPointKey(input.TxId, input.Index))
+        }
+        var err error
+        inputValue, err = AddAmount(inputValue, output.Value)
+        if err != nil {
+            return 0, err
+        }
+    }
+    outputValue, err := tx.OutputValue()
+    if err != nil {
+        return 0, err
+    }
+    if inputValue < outputValue {
+        return 0, fmt.Errorf("输出金额 %s 大于输入金额 %s", FormatAmount(outputValue), FormatAmount(inputValue))
+    }
+    return inputValue - outputValue, nil
+}
+
+// 校验区块中的挖矿交易
+// 挖矿交易必须是第一笔交易，并且金额不能超过该高度的挖矿奖励加上区块中所有交易的手续费
+func (blockChain *BlockChain) checkCoinBase(block *Block) error {
+    subsidy := BlockSubsidy(blockChain.params, blockChain.blockHeight(block))
+    if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinBase() {
+        return fmt.Errorf("第一笔交易不是挖矿交易")
+    }
+    var fees int64
+    for _, tx := range block.Transactions[1:] {
+        if tx.IsCoinBase() {
+            return fmt.Errorf("交易 %x 是多余的挖矿交易", tx.TxId)
+        }
+        fee, err := blockChain.TransactionFee(tx)
+        if err != nil {
+            return fmt.Errorf("交易 %x 无效: %v", tx.TxId, err)
+        }
+        fees, err = AddAmount(fees, fee)
+        if err != nil {
+            return err
+        }
+    }
+    total, err := block.Transactions[0].OutputValue()
+    if err != nil {
+        return err
+    }
+    if total > subsidy+fees {
+        return fmt.Errorf("挖矿交易的金额 %s 超过挖矿奖励和手续费 %s", FormatAmount(total), FormatAmount(subsidy+fees))
+    }
+    return nil
 }
 
 // 遍历账本，找到属于付款人的合适金额
-func (blockChain *BlockChain) FindNeedUTXOs(publicKeyHash []byte, amount float64) (map[string][]int, float64) {
+// 未成熟的挖矿奖励不能使用
+// 手动指定的 UTXO 总是使用，金额不足时按照选币策略从其余的 UTXO 中选择
+// selection 为空时使用默认的选币策略，手动指定的 UTXO 不可用时返回错误
+func (blockChain *BlockChain) FindNeedUTXOs(publicKeyHash []byte, amount int64, selection *CoinSelection) (map[string][]int, int64, error) {
     UTXOs := make(map[string][]int)
-    resValue := 0.0
+    var resValue int64
 
-    UTXOInfos := blockChain.FindMyUTXOs(publicKeyHash)
-    for _, UTXOInfo := range UTXOInfos {
-        key := string(UTXOInfo.TxId)
-        UTXOs[key] = append(UTXOs[key], UTXOInfo.Index)
+    if selection == nil {
+        selection = &CoinSelection{}
+    }
+    selector := selection.Selector
+    if selector == nil {
+        selector, _ = NewCoinSelector(DefaultCoinSelection)
+    }
+
+    // 交易池中的交易已经引用的 output
+    pendingSpent := blockChain.pendingSpentOutputs()
+
+    // 可用的 UTXO，交易id:索引 => UTXO
+    available := make(map[string]UTXOInfo)
+    var availableList []UTXOInfo
+    // 未成熟的挖矿奖励
+    immature := make(map[string]bool)
+    height := uint64(blockChain.Height() + 1)
+    for _, UTXOInfo := range blockChain.FindMyUTXOs(publicKeyHash) {
+        key := outPointKey(UTXOInfo.TxId, UTXOInfo.Index)
+        if pendingSpent[key] {
+            continue
+        }
+        if !UTXOInfo.IsMature(height) {
+            immature[key] = true
+            continue
+        }
+        available[key] = UTXOInfo
+        availableList = append(availableList, UTXOInfo)
+    }
+
+    // 先使用手动指定的 UTXO
+    var selected []UTXOInfo
+    pinned := make(map[string]bool)
+    for _, key := range selection.Pinned {
+        UTXOInfo, ok := available[key]
+        if immature[key] {
+            return nil, 0, fmt.Errorf("UTXO %s 是未成熟的挖矿奖励, 需要 %d 个区块确认", key, CoinBaseMaturity)
+        }
+        if !ok {
+            return nil, 0, fmt.Errorf("UTXO %s 不存在、不属于付款人或已被交易池中的交易使用", key)
+        }
+        if pinned[key] {
+            continue
+        }
+        pinned[key] = true
+        selected = append(selected, UTXOInfo)
         resValue += UTXOInfo.Output.Value
-        // 判断金额是否能够进行交易
-        if resValue >= amount {
-            // 可以进行交易，跳出循环
-            break
+    }
+
+    // 金额不足时按照选币策略选择其余的 UTXO
+    if resValue < amount {
+        var candidates []UTXOInfo
+        for _, UTXOInfo := range availableList {
+            if !pinned[outPointKey(UTXOInfo.TxId, UTXOInfo.Index)] {
+                candidates = append(candidates, UTXOInfo)
+            }
+        }
+        for _, UTXOInfo := range selector.Select(candidates, amount - resValue) {
+            selected = append(selected, UTXOInfo)
+            resValue += UTXOInfo.Output.Value
         }
     }
 
+    for _, UTXOInfo := range selected {
+        key := string(UTXOInfo.TxId)
+        UTXOs[key] = append(UTXOs[key], UTXOInfo.Index)
+    }
+
     // 返回 UTXO 和 金额
-    return UTXOs, resValue
+    return UTXOs, resValue, nil
 }
 
 // 交易签名
-func (blockChain *BlockChain) SignTransaction(tx *Transaction, privateKey *ecdsa.PrivateKey) {
+func (blockChain *BlockChain) SignTransaction(tx *Transaction, privateKey *secp256k1.PrivateKey) {
     fmt.Printf("对交易进行签名...\n")
 
     // 如果是挖矿交易，直接返回
@@ -243,6 +759,7 @@ func (blockChain *BlockChain) SignTransaction(tx *Transaction, privateKey *ecdsa
 }
 
 // 校验签名
+// 引用的挖矿交易 output 在下一个区块中必须已经成熟
 func (blockChain *BlockChain) VerifyTransaction(tx *Transaction) bool {
     fmt.Printf("对交易进行校验...\n")
 
@@ -251,33 +768,42 @@ func (blockChain *BlockChain) VerifyTransaction(tx *Transaction) bool {
         return true
     }
 
+    err := blockChain.CheckMaturity(tx, uint64(blockChain.Height() + 1))
+    if err != nil {
+        fmt.Printf("%v\n", err)
+        return false
+    }
+
     prevTxs := blockChain.FindTransaction(tx)
 
     return tx.Verify(prevTxs)
 }
 
 // 查找 input 引用的交易信息
+// 通过交易索引查找，不再遍历整个账本
 func (blockChain *BlockChain) FindTransaction(tx *Transaction) map[string]*Transaction {
     prevTxs := make(map[string]*Transaction)
-    it := blockChain.Iterator()
-    // 遍历区块
-    for block := it.Next() ; block != nil ; block = it.Next() {
-        // 遍历交易
-        for _, transaction := range block.Transactions {
-            // 遍历输入
-            for _, input := range tx.TxInputs {
-                if bytes.Equal(input.TxId, transaction.TxId) {
-                    prevTxs[string(input.TxId)] = tx
-                    fmt.Printf("找到交易 %x\n", input.TxId)
-                } else {
-                    fmt.Printf("未找到交易 %x\n", input.TxId)
-                }
-            }
+    for _, input := range tx.TxInputs {
+        if _, ok := prevTxs[string(input.TxId)]; ok {
+            continue
+        }
+        transaction, _ := blockChain.GetTransaction(input.TxId)
+        if transaction != nil {
+            prevTxs[string(input.TxId)] = transaction
         }
     }
     return prevTxs
 }
 
+// 查找交易所在的区块，并生成梅克尔证明
+func (blockChain *BlockChain) GetMerkleProof(txId []byte) (*Block, *MerkleProof) {
+    _, block := blockChain.GetTransaction(txId)
+    if block == nil {
+        return nil, nil
+    }
+    return block, block.MerkleProof(txId)
+}
+
 // 获取迭代器
 func (blockChain *BlockChain) Iterator() *BlockChainIterator {
     return NewBlockChainIterator(blockChain)
@@ -289,7 +815,7 @@ func (blockChain *BlockChain) Release() {
 
 func (blockChain *BlockChain) Clear() {
     blockChain.boltDB.Close()
-    err := os.Remove(DBPath)
+    err := os.Remove(dbPath())
     if err != nil {
         log.Fatal(err)
     }
@@ -297,20 +823,20 @@ func (blockChain *BlockChain) Clear() {
 
 // 迭代器
 type BlockChainIterator struct {
-    boltDB      *bolt.DB
+    blockChain  *BlockChain
     currentHash []byte
 }
 
 func NewBlockChainIterator(blockChain *BlockChain) *BlockChainIterator {
     return &BlockChainIterator{
-        boltDB:      blockChain.boltDB,
+        blockChain:  blockChain,
         currentHash: blockChain.lastBlockHash,
     }
 }
 
 func (it *BlockChainIterator) Next() *Block {
     var block *Block
-    it.boltDB.View(func(tx *bolt.Tx) error {
+    it.blockChain.view(func(tx *bolt.Tx) error {
         bucket := tx.Bucket([]byte(BucketName))
         value := bucket.Get(it.currentHash)
         if value != nil {
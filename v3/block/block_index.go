@@ -0,0 +1,199 @@
+package block
+
+import (
+    "bytes"
+    "encoding/gob"
+    "github.com/boltdb/bolt"
+    "log"
+)
+
+// 区块高度索引使用的 Bucket
+// key 为 8 字节大端序的区块高度，value 为主链上该高度的区块 hash
+const HeightBucketName = "height_bucket"
+
+// 将区块高度转换成索引的 key，大端序保证按照高度排序
+func heightToBytes(height uint64) []byte {
+    return uint64ToBytes(height)
+}
+
+// 判断是否需要重建区块高度索引
+// 旧版本的数据库没有区块高度索引，或者区块中没有累计工作量
+func needReindexHeight(tx *bolt.Tx) bool {
+    if tx.Bucket([]byte(HeightBucketName)) == nil {
+        return true
+    }
+    value := tx.Bucket([]byte(BucketName)).Get([]byte(LastHashKey))
+    if value == nil {
+        return false
+    }
+    value = tx.Bucket([]byte(BucketName)).Get(value)
+    if value == nil {
+        return false
+    }
+    block := Block{}
+    block.ToBlock(value)
+    return block.ChainWork == nil
+}
+
+// 重建区块高度索引
+// 旧版本的区块没有高度和累计工作量，从创世块开始依次写入
+func (blockChain *BlockChain) ReindexHeight() {
+    // 按照从创世块到最后一个区块的顺序
+    var blocks []*Block
+    it := blockChain.Iterator()
+    for block := it.Next() ; block != nil ; block = it.Next() {
+        blocks = append([]*Block{block}, blocks...)
+    }
+
+    err := blockChain.boltDB.Update(func(tx *bolt.Tx) error {
+        bucketName := []byte(HeightBucketName)
+        // 删除旧的索引
+        if tx.Bucket(bucketName) != nil {
+            err := tx.DeleteBucket(bucketName)
+            if err != nil {
+                return err
+            }
+        }
+        heightBucket, err := tx.CreateBucket(bucketName)
+        if err != nil {
+            return err
+        }
+        bucket := tx.Bucket([]byte(BucketName))
+        for _, block := range blocks {
+            err = storeBlock(bucket, block)
+            if err != nil {
+                return err
+            }
+            err = heightBucket.Put(heightToBytes(block.Height), block.Hash)
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        log.Panic(err)
+    }
+}
+
+// 根据高度获取主链上的区块
+func (blockChain *BlockChain) GetBlockByHeight(height uint64) *Block {
+    var hash []byte
+    blockChain.view(func(tx *bolt.Tx) error {
+        hash = copyBytes(tx.Bucket([]byte(HeightBucketName)).Get(heightToBytes(height)))
+        return nil
+    })
+    if hash == nil {
+        return nil
+    }
+    return blockChain.GetBlockByHash(hash)
+}
+
+// 交易索引使用的 Bucket
+// key 为交易 id，value 为交易所在的区块 hash 和交易在区块中的位置
+const TxIndexBucketName = "tx_index_bucket"
+
+// 交易在主链上的位置
+type TxLocation struct {
+    BlockHash []byte // 区块 hash
+    Position  int    // 交易在区块中的索引
+}
+
+// 将交易位置序列化
+func (location *TxLocation) ToBytes() []byte {
+    var buffer bytes.Buffer
+    encoder := gob.NewEncoder(&buffer)
+    err := encoder.Encode(location)
+    if err != nil {
+        log.Panic(err)
+    }
+    return buffer.Bytes()
+}
+
+// 将交易位置反序列化
+func (location *TxLocation) ToTxLocation(data []byte) {
+    decoder := gob.NewDecoder(bytes.NewReader(data))
+    err := decoder.Decode(location)
+    if err != nil {
+        log.Panic(err)
+    }
+}
+
+// 将区块中的交易加入交易索引
+func updateTxIndex(bucket *bolt.Bucket, block *Block) error {
+    for i, tx := range block.Transactions {
+        location := TxLocation{block.Hash, i}
+        err := bucket.Put(tx.TxId, location.ToBytes())
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// 重建交易索引
+func (blockChain *BlockChain) ReindexTransactions() {
+    var blocks []*Block
+    it := blockChain.Iterator()
+    for block := it.Next() ; block != nil ; block = it.Next() {
+        blocks = append([]*Block{block}, blocks...)
+    }
+
+    err := blockChain.boltDB.Update(func(tx *bolt.Tx) error {
+        bucketName := []byte(TxIndexBucketName)
+        // 删除旧的索引
+        if tx.Bucket(bucketName) != nil {
+            err := tx.DeleteBucket(bucketName)
+            if err != nil {
+                return err
+            }
+        }
+        bucket, err := tx.CreateBucket(bucketName)
+        if err != nil {
+            return err
+        }
+        // 按照从创世块开始的顺序，交易 id 重复时保留后面的交易
+        for _, block := range blocks {
+            err = updateTxIndex(bucket, block)
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        log.Panic(err)
+    }
+}
+
+// 根据交易 id 获取主链上的交易和交易所在的区块，没有找到时返回 nil
+func (blockChain *BlockChain) GetTransaction(txId []byte) (*Transaction, *Block) {
+    var transaction *Transaction
+    var block *Block
+    blockChain.view(func(tx *bolt.Tx) error {
+        transaction, block = getTransactionInTx(tx, txId)
+        return nil
+    })
+    return transaction, block
+}
+
+// 在事务中根据交易 id 获取主链上的交易和交易所在的区块
+func getTransactionInTx(tx *bolt.Tx, txId []byte) (*Transaction, *Block) {
+    value := tx.Bucket([]byte(TxIndexBucketName)).Get(txId)
+    if value == nil {
+        return nil, nil
+    }
+    location := TxLocation{}
+    location.ToTxLocation(value)
+
+    value = tx.Bucket([]byte(BucketName)).Get(location.BlockHash)
+    if value == nil {
+        return nil, nil
+    }
+    block := &Block{}
+    block.ToBlock(value)
+    if location.Position >= len(block.Transactions) {
+        return nil, nil
+    }
+    return block.Transactions[location.Position], block
+}
@@ -1,9 +1,13 @@
 package block
 
 import (
+    "encoding/hex"
     "flag"
     "fmt"
+    "os"
     "strconv"
+    "strings"
+    "time"
 )
 
 type CLI struct {
@@ -19,13 +23,89 @@ func (cli *CLI) Run() {
     var wallet bool
     var listWallet bool
     var listTransaction bool
+    var reindexUTXO bool
+    var merkleProof string
+    var startNode string
+    var relay bool
+    var mine string
+    var listMempool bool
+    var clearMempool bool
+    var listOrphans bool
+    var verifyChain bool
+    var migrateAmounts bool
+    var feeStr string
+    var feeRate int64
+    var coinSelect string
+    var utxos string
+    var lockTime string
+    var relativeLockTime string
+    var supply bool
+    var initialSubsidy string
+    var halvingInterval int
+    var encryptWallet bool
+    var changePassphrase bool
+    var decryptWalletFile bool
+    var showMnemonic bool
+    var restoreWallet bool
+    var exportKey string
+    var importKey string
+    var rescan bool
+    var watchAddress string
+    var walletBalance bool
+    var createMultiSig int
+    var signMultiSig string
+    var showPublicKey string
+    var createTx string
+    var signTx string
+    var submitTx string
+    var history string
+    var showBlock string
+    var showTx string
     flag.StringVar(&data, "create-block-chain", "", "创建区块链")
+    flag.StringVar(&initialSubsidy, "initial-subsidy", FormatAmount(DefaultInitialSubsidy), "与 -create-block-chain 或 -start-node 一起使用，新建区块链时指定初始挖矿奖励")
+    flag.IntVar(&halvingInterval, "halving-interval", DefaultHalvingInterval, "与 -create-block-chain 或 -start-node 一起使用，新建区块链时指定每隔多少个区块奖励减半")
     flag.StringVar(&addr, "get-balance", "", "获取余额")
-    flag.BoolVar(&send, "send", false, "转账（付款人 收款人 转账金额 miner）")
+    flag.BoolVar(&send, "send", false, "转账（付款人 收款人 转账金额 [miner]），不指定矿工时只加入交易池")
+    flag.StringVar(&feeStr, "fee", "0", "与 -send 一起使用，指定手续费")
+    flag.Int64Var(&feeRate, "fee-rate", 0, "与 -send 一起使用，指定每字节的手续费（聪），设置后忽略 -fee")
+    flag.StringVar(&coinSelect, "coin-select", DefaultCoinSelection, "与 -send 一起使用，指定选币策略（largest|smallest|bnb|random）")
+    flag.StringVar(&utxos, "utxos", "", "与 -send 一起使用，手动指定作为 input 的 UTXO（交易id:索引，多个使用逗号分隔）")
+    flag.StringVar(&lockTime, "lock-time", "", "与 -send 一起使用，指定交易的锁定时间（区块高度、Unix 时间戳或 \"2006-01-02 15:04:05\"）")
+    flag.StringVar(&relativeLockTime, "relative-lock-time", "", "与 -send 一起使用，指定 input 的相对锁定时间（区块数，或以 s 结尾的秒数）")
+    flag.StringVar(&createTx, "create-tx", "", "与 -send 一起使用，创建未签名的交易并保存到文件，付款人可以是只读地址")
+    flag.StringVar(&signTx, "sign-tx", "", "使用钱包中的私钥签名部分签名交易文件，确认金额和手续费后签名，不需要区块链")
+    flag.StringVar(&submitTx, "submit-tx", "", "提交签名完成的交易文件（文件名 [miner]），不指定矿工时只加入交易池")
+    flag.StringVar(&mine, "mine", "", "将交易池中的交易打包成区块（矿工地址）")
+    flag.BoolVar(&listMempool, "list-mempool", false, "显示交易池中的交易")
+    flag.BoolVar(&clearMempool, "clear-mempool", false, "清空交易池")
+    flag.BoolVar(&listOrphans, "list-orphans", false, "只读打开数据库显示孤块池中的区块, 数据库被运行中的节点占用时等待 3 秒后失败")
+    flag.BoolVar(&relay, "relay", false, "与 -send 或 -submit-tx 一起使用，将交易发送到已知节点，不在本地挖矿")
     flag.BoolVar(&list, "list", false, "显示所有区块")
-    flag.BoolVar(&wallet, "create-wallet", false, "创建钱包")
+    flag.BoolVar(&wallet, "create-wallet", false, "创建钱包（从助记词派生下一个地址）")
+    flag.BoolVar(&showMnemonic, "show-mnemonic", false, "显示钱包的助记词")
+    flag.BoolVar(&restoreWallet, "restore-wallet", false, "使用助记词恢复钱包，并扫描区块链恢复使用过的地址")
     flag.BoolVar(&listWallet, "list-wallet", false, "显示所有钱包地址")
+    flag.StringVar(&watchAddress, "watch-address", "", "添加只读地址（地址或十六进制公钥）")
+    flag.BoolVar(&walletBalance, "wallet-balance", false, "显示钱包中所有地址的余额，包括只读地址")
+    flag.StringVar(&showPublicKey, "show-public-key", "", "显示钱包地址的公钥（十六进制）")
+    flag.IntVar(&createMultiSig, "create-multisig", 0, "创建 M-of-N 多重签名地址（需要的签名数 M，参数为 N 个公钥或钱包地址）")
+    flag.StringVar(&signMultiSig, "sign-multisig", "", "为部分签名的交易添加签名（十六进制交易 [miner]），签名足够后加入交易池")
+    flag.StringVar(&exportKey, "export-key", "", "导出地址的私钥（WIF 格式）")
+    flag.StringVar(&importKey, "import-key", "", "导入 WIF 格式的私钥")
+    flag.BoolVar(&rescan, "rescan", false, "与 -import-key 一起使用，扫描区块链并显示导入地址的余额")
+    flag.BoolVar(&encryptWallet, "encrypt-wallet", false, "使用密码加密钱包文件，之后需要私钥的命令会提示输入密码，只在内存中解密")
+    flag.BoolVar(&changePassphrase, "change-passphrase", false, "修改钱包密码")
+    flag.BoolVar(&decryptWalletFile, "decrypt-wallet-file", false, "永久解除钱包加密，私钥以明文写回钱包文件（不是解锁）")
     flag.BoolVar(&listTransaction, "list-transaction", false, "显示所有交易")
+    flag.StringVar(&history, "history", "", "显示地址的交易记录")
+    flag.StringVar(&showBlock, "show-block", "", "显示区块及其交易（区块高度或 hash）")
+    flag.StringVar(&showTx, "show-tx", "", "显示交易及其所在的区块（交易 id）")
+    flag.StringVar(&merkleProof, "merkle-proof", "", "生成交易的梅克尔证明")
+    flag.BoolVar(&supply, "supply", false, "显示发行量（[高度]）")
+    flag.BoolVar(&verifyChain, "verify-chain", false, "校验所有区块和交易")
+    flag.BoolVar(&migrateAmounts, "migrate-amounts", false, "将旧版本数据库中的金额迁移为聪")
+    flag.BoolVar(&reindexUTXO, "reindex-utxo", false, "重建 UTXO 集合")
+    flag.StringVar(&startNode, "start-node", "", "启动节点（full|miner|wallet），矿工节点需要指定矿工地址，使用 NODE_ID 设置端口")
     flag.BoolVar(&clear, "clear", false, "删除所有区块")
     // 解析命令行参数写入注册的flag里
     flag.Parse()
@@ -38,8 +118,13 @@ func (cli *CLI) Run() {
                 fmt.Printf("%s 格式错误!\n", data)
                 return
             }
+            params, err := NewChainParams(initialSubsidy, halvingInterval)
+            if err != nil {
+                fmt.Printf("%v!\n", err)
+                return
+            }
             // 创建区块链
-            NewBlockChain(data)
+            blockChain = NewBlockChain(data, params)
             fmt.Println("创建区块链成功!!!")
         case addr != "":
             if !IsValidAddress(addr) {
@@ -53,11 +138,14 @@ func (cli *CLI) Run() {
             // 转账
             blockChain = GetBlockChain()
             args := flag.Args()
-            if len(args) == 4 {
+            if len(args) == 3 || len(args) == 4 {
                 sender := args[0]
                 receiver := args[1]
-                amount, _ := strconv.ParseFloat(args[2], 64)
-                miner := args[3]
+                amount, err := ParseAmount(args[2])
+                if err != nil {
+                    fmt.Printf("%v!\n", err)
+                    return
+                }
 
                 if !IsValidAddress(sender) {
                     fmt.Printf("%s 格式错误!\n", sender)
@@ -67,27 +155,166 @@ func (cli *CLI) Run() {
                     fmt.Printf("%s 格式错误!\n", receiver)
                     return
                 }
-                if !IsValidAddress(miner) {
-                    fmt.Printf("%s 格式错误!\n", miner)
+                var miner string
+                if len(args) == 4 {
+                    miner = args[3]
+                    if !IsValidAddress(miner) {
+                        fmt.Printf("%s 格式错误!\n", miner)
+                        return
+                    }
+                }
+
+                fee, err := ParseAmount(feeStr)
+                if err != nil {
+                    fmt.Printf("手续费%v!\n", err)
+                    return
+                }
+                if feeRate < 0 {
+                    fmt.Println("手续费率不能为负数!")
                     return
                 }
 
-                // 创建挖矿交易
-                coinBase := NewCoinBaseTx(miner, firstData)
-                txs := []*Transaction{coinBase}
+                selector, err := NewCoinSelector(coinSelect)
+                if err != nil {
+                    fmt.Printf("%v!\n", err)
+                    return
+                }
+                pinned, err := ParsePinnedUTXOs(utxos)
+                if err != nil {
+                    fmt.Printf("%v!\n", err)
+                    return
+                }
+                selection := &CoinSelection{selector, pinned}
+                timeLock, err := NewTimeLock(lockTime, relativeLockTime)
+                if err != nil {
+                    fmt.Printf("%v!\n", err)
+                    return
+                }
+
+                // 只创建未签名的交易，保存到文件
+                if createTx != "" {
+                    var tx *Transaction
+                    if feeRate > 0 {
+                        tx = NewUnsignedTransactionWithFeeRate(sender, receiver, amount, feeRate, selection, timeLock, blockChain)
+                    } else {
+                        tx = NewUnsignedTransaction(sender, receiver, amount, fee, selection, timeLock, blockChain)
+                    }
+                    if tx == nil {
+                        fmt.Println("无效交易!")
+                        break
+                    }
+                    psbt, err := NewPartiallySignedTx(tx, blockChain)
+                    if err != nil {
+                        fmt.Printf("%v!\n", err)
+                        break
+                    }
+                    err = psbt.Save(createTx)
+                    if err != nil {
+                        fmt.Printf("保存交易失败: %v\n", err)
+                        break
+                    }
+                    fmt.Println(psbt)
+                    fmt.Printf("未签名的交易已保存到 %s\n", createTx)
+                    break
+                }
+
                 // 普通交易
-                tx := NewTransaction(sender, receiver, amount, blockChain)
-                if tx != nil {
-                    txs = append(txs, tx)
+                var tx *Transaction
+                if feeRate > 0 {
+                    tx = NewTransactionWithFeeRate(sender, receiver, amount, feeRate, selection, timeLock, blockChain)
                 } else {
+                    tx = NewTransaction(sender, receiver, amount, fee, selection, timeLock, blockChain)
+                }
+
+                // 创建交易失败时不挖矿
+                if tx == nil {
                     fmt.Println("无效交易!")
+                    break
+                }
+
+                // 多重签名地址的签名不足时，交给其他持有人添加签名
+                if tx.MissingSignatures() > 0 {
+                    fmt.Printf("交易 %x 还需要 %d 个签名, 使用 -sign-multisig 添加签名:\n%s\n", tx.TxId, tx.MissingSignatures(), tx.ToHex())
+                    break
+                }
+
+                // 将交易发送到其他节点，由矿工节点打包
+                if relay {
+                    SendTransaction(tx)
+                    fmt.Printf("交易 %x 已发送\n", tx.TxId)
+                    break
+                }
+
+                // 加入交易池
+                pool := NewMempool(blockChain, true)
+                err = pool.Add(tx)
+                if err != nil {
+                    fmt.Printf("无效交易: %v\n", err)
+                    break
                 }
+                fmt.Printf("交易 %x 已加入交易池\n", tx.TxId)
 
-                // 添加区块
-                blockChain.AddBlock(txs)
+                // 指定了矿工时，将交易池中的交易打包成区块
+                if miner != "" {
+                    blockData, err := blockChain.MineBlock(miner, pool)
+                    if err != nil {
+                        fmt.Printf("挖矿失败: %v\n", err)
+                        return
+                    }
+                    fmt.Printf("打包 %d 笔交易\n", len(blockData.Transactions))
+                }
             } else {
                 fmt.Println("参数错误!")
             }
+        case mine != "":
+            // 打包交易池中的交易
+            if !IsValidAddress(mine) {
+                fmt.Printf("%s 格式错误!\n", mine)
+                return
+            }
+            blockChain = GetBlockChain()
+            pool := NewMempool(blockChain, true)
+            blockData, err := blockChain.MineBlock(mine, pool)
+            if err != nil {
+                fmt.Printf("挖矿失败: %v\n", err)
+                return
+            }
+            fmt.Printf("打包 %d 笔交易\n", len(blockData.Transactions))
+        case listMempool:
+            // 显示交易池
+            blockChain = GetBlockChain()
+            pool := NewMempool(blockChain, true)
+            txs := pool.Transactions()
+            fmt.Printf("交易池中共有 %d 笔交易\n", len(txs))
+            for _, tx := range txs {
+                fmt.Print(tx)
+                fee, _ := blockChain.TransactionFee(tx)
+                fmt.Printf("\n    Fee: %s", FormatAmount(fee))
+            }
+            fmt.Println()
+        case clearMempool:
+            // 清空交易池
+            blockChain = GetBlockChain()
+            pool := NewMempool(blockChain, true)
+            txs := pool.Drain()
+            fmt.Printf("删除 %d 笔交易\n", len(txs))
+        case listOrphans:
+            // 显示孤块池
+            // 只读打开数据库，节点运行时也可以查看
+            var err error
+            blockChain, err = GetBlockChainReadOnly()
+            if err != nil {
+                fmt.Printf("打开区块链失败: %v\n", err)
+                break
+            }
+            orphans := LoadOrphans(blockChain)
+            fmt.Printf("孤块池中共有 %d 个区块, 上限 %d 个, 最长保存 %d 秒\n", len(orphans), MaxOrphanBlocks, MaxOrphanAge)
+            for _, orphan := range orphans {
+                fmt.Printf("Hash: %x\n", orphan.Block.Hash)
+                fmt.Printf("    PrevHash: %x\n", orphan.Block.PrevHash)
+                fmt.Printf("    Received: %s\n", time.Unix(orphan.Received, 0).Format("2006-01-02 15:04:05"))
+                fmt.Printf("    Transactions: %d\n", len(orphan.Block.Transactions))
+            }
         case list:
             // 打印区块
             blockChain = GetBlockChain()
@@ -98,29 +325,391 @@ func (cli *CLI) Run() {
             for ; blockData != nil ; blockData = iterator.Next() {
                 i++
                 fmt.Printf("=================%d===================\n", i)
-                fmt.Printf("Version: %d\n", blockData.Version)
-                fmt.Printf("PrevHash: %x\n", blockData.PrevHash)
-                fmt.Printf("MerKleRoot: %x\n", blockData.MerKleRoot)
-                fmt.Printf("Timestamp: %d\n", blockData.Timestamp)
-                fmt.Printf("Difficulty: %d\n", blockData.Difficulty)
-                fmt.Printf("Nonce: %d\n", blockData.Nonce)
-                fmt.Printf("Hash: %x\n", blockData.Hash)
-
-                pow := NewProofOfWork(blockData)
-                fmt.Printf("IsValid: %v\n", pow.IsValid())
+                printBlock(blockChain, blockData)
             }
+        case showBlock != "":
+            // 显示区块
+            blockChain = GetBlockChain()
+            var blockData *Block
+            // 64 位十六进制为区块 hash，否则为区块高度
+            if hash, err := hex.DecodeString(showBlock); err == nil && len(hash) == 32 {
+                blockData = blockChain.GetBlockByHash(hash)
+            } else if height, err := strconv.ParseUint(showBlock, 10, 64); err == nil {
+                blockData = blockChain.GetBlockByHeight(height)
+            } else {
+                fmt.Printf("%s 格式错误!\n", showBlock)
+                break
+            }
+            if blockData == nil {
+                fmt.Printf("未找到区块 %s\n", showBlock)
+                break
+            }
+            printBlock(blockChain, blockData)
+            fmt.Printf("Transactions: %d\n", len(blockData.Transactions))
+            for _, tx := range blockData.Transactions {
+                fmt.Print(tx)
+            }
+            fmt.Println()
         case wallet:
             // 创建钱包
             wallets := NewWallets()
+            if !wallets.UnlockWithPrompt() {
+                return
+            }
+            // 第一次创建时生成助记词
+            if !wallets.HasHDChain() {
+                mnemonic, err := wallets.NewHDChain()
+                if err != nil {
+                    fmt.Printf("生成助记词失败: %v\n", err)
+                    return
+                }
+                fmt.Printf("助记词: %s\n", mnemonic)
+                fmt.Println("请妥善备份助记词, 使用 -restore-wallet 可以恢复所有派生的地址!")
+            }
             address := wallets.CreateWallet()
+            wallets.Lock()
             fmt.Printf("钱包地址: %s", address)
+        case showMnemonic:
+            // 显示助记词
+            wallets := NewWallets()
+            if !wallets.HasHDChain() {
+                fmt.Println("钱包没有助记词, 使用 -create-wallet 生成!")
+                return
+            }
+            if !wallets.UnlockWithPrompt() {
+                return
+            }
+            mnemonic, err := wallets.Mnemonic()
+            wallets.Lock()
+            if err != nil {
+                fmt.Printf("%v!\n", err)
+                return
+            }
+            fmt.Printf("助记词: %s\n", mnemonic)
+        case restoreWallet:
+            // 使用助记词恢复钱包
+            wallets := NewWallets()
+            if !wallets.UnlockWithPrompt() {
+                return
+            }
+            mnemonic := readLine("请输入助记词: ")
+            // 没有区块链时只恢复助记词
+            var used map[string]bool
+            if _, err := os.Stat(dbPath()); err == nil {
+                blockChain = GetBlockChain()
+                used = blockChain.UsedPublicKeyHashes()
+            }
+            count, err := wallets.RestoreHDChain(mnemonic, used)
+            wallets.Lock()
+            if err != nil {
+                fmt.Printf("恢复钱包失败: %v\n", err)
+                return
+            }
+            fmt.Printf("恢复钱包成功, 恢复了 %d 个使用过的地址!!!\n", count)
+        case watchAddress != "":
+            // 添加只读地址
+            wallets := NewWallets()
+            address, err := wallets.AddWatchOnly(watchAddress)
+            if err != nil {
+                fmt.Printf("添加只读地址失败: %v!\n", err)
+                return
+            }
+            fmt.Printf("添加只读地址成功, 钱包地址: %s\n", address)
+        case showPublicKey != "":
+            // 显示公钥
+            wallets := NewWallets()
+            publicKey, err := wallets.PublicKey(showPublicKey)
+            if err != nil {
+                fmt.Printf("%v!\n", err)
+                return
+            }
+            fmt.Printf("公钥: %x\n", publicKey)
+        case createMultiSig != 0:
+            // 创建多重签名地址
+            wallets := NewWallets()
+            address, err := wallets.AddMultiSig(createMultiSig, flag.Args())
+            if err != nil {
+                fmt.Printf("创建多重签名地址失败: %v!\n", err)
+                return
+            }
+            m, n := wallets.MultiSig[address].Required()
+            fmt.Printf("多重签名地址: %s (%d-of-%d)\n", address, m, n)
+            fmt.Printf("赎回脚本: %s\n", DisassembleScript(wallets.MultiSig[address].RedeemScript))
+        case signMultiSig != "":
+            // 为部分签名的交易添加签名
+            tx, err := NewTransactionFromHex(signMultiSig)
+            if err != nil {
+                fmt.Printf("%v!\n", err)
+                return
+            }
+            var miner string
+            if args := flag.Args(); len(args) == 1 {
+                miner = args[0]
+                if !IsValidAddress(miner) {
+                    fmt.Printf("%s 格式错误!\n", miner)
+                    return
+                }
+            }
+            wallets := NewWallets()
+            if !wallets.UnlockWithPrompt() {
+                return
+            }
+            count, err := wallets.SignMultiSig(tx)
+            wallets.Lock()
+            if err != nil {
+                fmt.Printf("签名失败: %v!\n", err)
+                return
+            }
+            fmt.Printf("添加了 %d 个签名\n", count)
+            if missing := tx.MissingSignatures(); missing > 0 {
+                fmt.Printf("交易 %x 还需要 %d 个签名:\n%s\n", tx.TxId, missing, tx.ToHex())
+                return
+            }
+
+            // 签名足够，加入交易池，没有区块链时交给有区块链的节点提交
+            if _, err := os.Stat(dbPath()); err != nil {
+                fmt.Printf("签名完成, 区块链不存在, 请在有区块链的节点使用 -sign-multisig 提交:\n%s\n", tx.ToHex())
+                return
+            }
+            blockChain = GetBlockChain()
+            pool := NewMempool(blockChain, true)
+            err = pool.Add(tx)
+            if err != nil {
+                fmt.Printf("无效交易: %v\n", err)
+                return
+            }
+            fmt.Printf("交易 %x 已加入交易池\n", tx.TxId)
+            if miner != "" {
+                blockData, err := blockChain.MineBlock(miner, pool)
+                if err != nil {
+                    fmt.Printf("挖矿失败: %v\n", err)
+                    return
+                }
+                fmt.Printf("打包 %d 笔交易\n", len(blockData.Transactions))
+            }
+        case signTx != "":
+            // 签名交易文件
+            psbt, err := LoadPartiallySignedTx(signTx)
+            if err != nil {
+                fmt.Printf("读取交易失败: %v\n", err)
+                return
+            }
+            fmt.Println(psbt)
+            // 引用的交易不可信时，显示的金额和手续费也不可信
+            err = psbt.CheckPrevTxs()
+            if err != nil {
+                fmt.Printf("无效交易: %v!\n", err)
+                return
+            }
+            if !ReadConfirm("确认金额和手续费并签名") {
+                fmt.Println("已取消")
+                return
+            }
+            wallets := NewWallets()
+            if !wallets.UnlockWithPrompt() {
+                return
+            }
+            count, err := wallets.SignPartiallySignedTx(psbt)
+            wallets.Lock()
+            if err != nil {
+                fmt.Printf("签名失败: %v!\n", err)
+                return
+            }
+            err = psbt.Save(signTx)
+            if err != nil {
+                fmt.Printf("保存交易失败: %v\n", err)
+                return
+            }
+            fmt.Printf("添加了 %d 个签名, 还需要 %d 个签名, 已保存到 %s\n", count, psbt.Tx.MissingSignatures(), signTx)
+        case submitTx != "":
+            // 提交交易文件
+            psbt, err := LoadPartiallySignedTx(submitTx)
+            if err != nil {
+                fmt.Printf("读取交易失败: %v\n", err)
+                return
+            }
+            tx := psbt.Tx
+            if missing := tx.MissingSignatures(); missing > 0 {
+                fmt.Printf("交易 %x 还需要 %d 个签名, 请先使用 -sign-tx 签名!\n", tx.TxId, missing)
+                return
+            }
+            var miner string
+            if args := flag.Args(); len(args) == 1 {
+                miner = args[0]
+                if !IsValidAddress(miner) {
+                    fmt.Printf("%s 格式错误!\n", miner)
+                    return
+                }
+            }
+            blockChain = GetBlockChain()
+            err = psbt.Check(blockChain)
+            if err != nil {
+                fmt.Printf("无效交易: %v\n", err)
+                return
+            }
+            if relay {
+                SendTransaction(tx)
+                fmt.Printf("交易 %x 已发送\n", tx.TxId)
+                break
+            }
+            pool := NewMempool(blockChain, true)
+            err = pool.Add(tx)
+            if err != nil {
+                fmt.Printf("无效交易: %v\n", err)
+                return
+            }
+            fmt.Printf("交易 %x 已加入交易池\n", tx.TxId)
+            if miner != "" {
+                blockData, err := blockChain.MineBlock(miner, pool)
+                if err != nil {
+                    fmt.Printf("挖矿失败: %v\n", err)
+                    return
+                }
+                fmt.Printf("打包 %d 笔交易\n", len(blockData.Transactions))
+            }
+        case walletBalance:
+            // 钱包余额
+            wallets := NewWallets()
+            blockChain = GetBlockChain()
+            var total int64
+            var totalImmature int64
+            for _, address := range wallets.ListAddress() {
+                balance, immature := blockChain.Balance(address)
+                total += balance
+                totalImmature += immature
+                var note string
+                if immature > 0 {
+                    note = fmt.Sprintf(", 未成熟的挖矿奖励为%s", FormatAmount(immature))
+                }
+                if wallets.IsWatchOnly(address) {
+                    fmt.Printf("%s的余额为%s%s (只读)\n", address, FormatAmount(balance), note)
+                    continue
+                }
+                if wallets.IsMultiSig(address) {
+                    fmt.Printf("%s的余额为%s%s (多重签名)\n", address, FormatAmount(balance), note)
+                    continue
+                }
+                fmt.Printf("%s的余额为%s%s\n", address, FormatAmount(balance), note)
+            }
+            fmt.Printf("总余额为%s\n", FormatAmount(total))
+            if totalImmature > 0 {
+                fmt.Printf("未成熟的挖矿奖励为%s\n", FormatAmount(totalImmature))
+            }
+        case exportKey != "":
+            // 导出私钥
+            wallets := NewWallets()
+            if !wallets.UnlockWithPrompt() {
+                return
+            }
+            wif, err := wallets.ExportKey(exportKey)
+            wallets.Lock()
+            if err != nil {
+                fmt.Printf("导出私钥失败: %v!\n", err)
+                return
+            }
+            fmt.Printf("私钥: %s\n", wif)
+        case importKey != "":
+            // 导入私钥
+            wallets := NewWallets()
+            if !wallets.UnlockWithPrompt() {
+                return
+            }
+            address, err := wallets.ImportKey(importKey)
+            wallets.Lock()
+            if err != nil {
+                fmt.Printf("导入私钥失败: %v!\n", err)
+                return
+            }
+            fmt.Printf("导入私钥成功, 钱包地址: %s\n", address)
+            if !rescan {
+                return
+            }
+            if _, err := os.Stat(dbPath()); err != nil {
+                fmt.Println("区块链不存在, 跳过扫描!")
+                return
+            }
+            blockChain = GetBlockChain()
+            fmt.Printf("扫描区块链, 找到 %d 笔相关交易\n", blockChain.CountTransactions(Lock(address)))
+            blockChain.GetBalance(address)
         case listWallet:
             // 显示钱包
             wallets := NewWallets()
             addresses := wallets.ListAddress()
             for _, address := range addresses {
+                if wallets.IsWatchOnly(address) {
+                    fmt.Printf("钱包地址: %s  (只读)\n", address)
+                    continue
+                }
+                if multiSig, ok := wallets.MultiSig[address]; ok {
+                    m, n := multiSig.Required()
+                    fmt.Printf("钱包地址: %s  (多重签名 %d-of-%d)\n", address, m, n)
+                    continue
+                }
+                if path := wallets.HDPath(address); path != "" {
+                    fmt.Printf("钱包地址: %s  %s\n", address, path)
+                    continue
+                }
                 fmt.Printf("钱包地址: %s\n", address)
             }
+        case encryptWallet:
+            // 加密钱包
+            wallets := NewWallets()
+            if wallets.IsEncrypted() {
+                fmt.Println("钱包已加密!")
+                return
+            }
+            passphrase, err := ReadNewPassphrase(PassphraseEnv)
+            if err != nil {
+                fmt.Printf("%v!\n", err)
+                return
+            }
+            err = wallets.Encrypt(passphrase)
+            if err != nil {
+                fmt.Printf("加密钱包失败: %v\n", err)
+                return
+            }
+            fmt.Println("钱包已加密!!!")
+        case changePassphrase:
+            // 修改密码
+            wallets := NewWallets()
+            if !wallets.IsEncrypted() {
+                fmt.Println("钱包没有加密!")
+                return
+            }
+            oldPassphrase := ReadPassphrase("请输入钱包密码: ")
+            if err := wallets.Unlock(oldPassphrase); err != nil {
+                fmt.Printf("解锁钱包失败: %v\n", err)
+                return
+            }
+            newPassphrase, err := ReadNewPassphrase(NewPassphraseEnv)
+            if err != nil {
+                fmt.Printf("%v!\n", err)
+                return
+            }
+            err = wallets.ChangePassphrase(oldPassphrase, newPassphrase)
+            if err != nil {
+                fmt.Printf("修改密码失败: %v\n", err)
+                return
+            }
+            fmt.Println("修改密码成功!!!")
+        case decryptWalletFile:
+            // 永久解除加密，私钥以明文写回钱包文件
+            wallets := NewWallets()
+            if !wallets.IsEncrypted() {
+                fmt.Println("钱包没有加密!")
+                return
+            }
+            fmt.Println("解除加密后私钥将以明文保存在钱包文件中, 使用私钥的命令不需要解除加密, 会提示输入密码临时解锁")
+            if !ReadConfirm("确认解除加密") {
+                fmt.Println("已取消")
+                return
+            }
+            err := wallets.DecryptFile(ReadPassphrase("请输入钱包密码: "))
+            if err != nil {
+                fmt.Printf("解除加密失败: %v\n", err)
+                return
+            }
+            fmt.Println("钱包已解除加密, 私钥以明文保存!!!")
         case listTransaction:
             // 显示交易
             blockChain = GetBlockChain()
@@ -132,6 +721,138 @@ func (cli *CLI) Run() {
                     fmt.Print(tx)
                 }
             }
+        case history != "":
+            // 交易记录
+            if !IsValidAddress(history) {
+                fmt.Printf("%s 格式错误!\n", history)
+                return
+            }
+            blockChain = GetBlockChain()
+            entries := blockChain.History(history)
+            if len(entries) == 0 {
+                fmt.Printf("%s 没有交易记录\n", history)
+                return
+            }
+            for _, entry := range entries {
+                amount := FormatAmount(entry.Amount)
+                if entry.Amount >= 0 {
+                    amount = "+" + amount
+                }
+                fmt.Printf("高度: %d  时间: %s  %s  %s  余额: %s\n", entry.Height,
+                    time.Unix(int64(entry.Timestamp), 0).Format("2006-01-02 15:04:05"),
+                    entry.Direction, amount, FormatAmount(entry.Balance))
+                fmt.Printf("    交易: %x\n", entry.TxId)
+                if len(entry.Counterparties) > 0 {
+                    fmt.Printf("    对方: %s\n", strings.Join(entry.Counterparties, ", "))
+                }
+            }
+        case showTx != "":
+            // 显示交易
+            txId, err := hex.DecodeString(showTx)
+            if err != nil {
+                fmt.Printf("%s 格式错误!\n", showTx)
+                return
+            }
+            blockChain = GetBlockChain()
+            tx, blockData := blockChain.GetTransaction(txId)
+            if tx == nil {
+                fmt.Printf("未找到交易 %s\n", showTx)
+                break
+            }
+            fmt.Printf("Block: %x\n", blockData.Hash)
+            fmt.Printf("Height: %d\n", blockData.Height)
+            fmt.Print(tx)
+            fmt.Println()
+        case supply:
+            // 发行量
+            blockChain = GetBlockChain()
+            height := blockChain.Height()
+            args := flag.Args()
+            if len(args) == 1 {
+                var err error
+                height, err = strconv.Atoi(args[0])
+                if err != nil || height < 0 {
+                    fmt.Printf("%s 格式错误!\n", args[0])
+                    break
+                }
+            }
+            fmt.Printf("高度: %d\n", height)
+            params := blockChain.Params()
+            fmt.Printf("初始挖矿奖励: %s, 每 %d 个区块减半\n", FormatAmount(params.InitialSubsidy), params.HalvingInterval)
+            fmt.Printf("区块奖励: %s\n", FormatAmount(BlockSubsidy(params, height)))
+            fmt.Printf("计划发行量: %s\n", FormatAmount(TotalSupply(params, height)))
+            if len(args) == 0 {
+                fmt.Printf("实际发行量: %s\n", FormatAmount(blockChain.IssuedSupply()))
+            }
+            fmt.Printf("发行总量上限: %s\n", FormatAmount(MaxSupply(params)))
+        case verifyChain:
+            // 校验区块链
+            blockChain = GetBlockChain()
+            err := blockChain.Validate()
+            if err != nil {
+                fmt.Println(err)
+            } else {
+                fmt.Printf("区块链校验通过, 共 %d 个区块\n", blockChain.Height()+1)
+            }
+        case migrateAmounts:
+            // 迁移金额
+            err := MigrateAmounts()
+            if err != nil {
+                fmt.Printf("迁移失败: %v\n", err)
+                return
+            }
+            // 重建 UTXO 集合
+            blockChain = GetBlockChain()
+            fmt.Println("迁移成功!!!")
+        case reindexUTXO:
+            // 重建 UTXO 集合
+            blockChain = GetBlockChain()
+            blockChain.ReindexUTXO()
+            fmt.Printf("重建 UTXO 集合成功, 共有 %d 笔交易包含 UTXO\n", blockChain.CountUTXOTransactions())
+        case merkleProof != "":
+            // 梅克尔证明
+            txId, err := hex.DecodeString(merkleProof)
+            if err != nil {
+                fmt.Printf("%s 格式错误!\n", merkleProof)
+                return
+            }
+            blockChain = GetBlockChain()
+            blockData, proof := blockChain.GetMerkleProof(txId)
+            if proof == nil {
+                fmt.Printf("未找到交易 %s\n", merkleProof)
+                break
+            }
+            fmt.Printf("Block: %x\n", blockData.Hash)
+            fmt.Printf("MerKleRoot: %x\n", blockData.MerKleRoot)
+            fmt.Println(proof)
+            fmt.Printf("IsValid: %v\n", proof.Verify(blockData))
+        case startNode != "":
+            // 启动节点
+            if GetNodeId() == "" {
+                fmt.Printf("请设置环境变量 %s!\n", NodeIdEnv)
+                return
+            }
+            if !IsValidRole(startNode) {
+                fmt.Printf("%s 角色错误!\n", startNode)
+                return
+            }
+            var miner string
+            if startNode == RoleMiner {
+                args := flag.Args()
+                if len(args) != 1 || !IsValidAddress(args[0]) {
+                    fmt.Println("请指定正确的矿工地址!")
+                    return
+                }
+                miner = args[0]
+            }
+            params, err := NewChainParams(initialSubsidy, halvingInterval)
+            if err != nil {
+                fmt.Printf("%v!\n", err)
+                return
+            }
+            blockChain = OpenBlockChain(params)
+            node := NewNode(startNode, miner, blockChain)
+            node.Start()
         case clear:
             // 删除区块
             blockChain = GetBlockChain()
@@ -144,3 +865,19 @@ func (cli *CLI) Run() {
         blockChain.Release()
     }
 }
+
+// 打印区块头
+func printBlock(blockChain *BlockChain, blockData *Block) {
+    fmt.Printf("Height: %d\n", blockData.Height)
+    fmt.Printf("Version: %d\n", blockData.Version)
+    fmt.Printf("PrevHash: %x\n", blockData.PrevHash)
+    fmt.Printf("MerKleRoot: %x\n", blockData.MerKleRoot)
+    fmt.Printf("Timestamp: %d\n", blockData.Timestamp)
+    fmt.Printf("Difficulty: %#x\n", blockData.Difficulty)
+    fmt.Printf("Nonce: %d\n", blockData.Nonce)
+    fmt.Printf("Hash: %x\n", blockData.Hash)
+    fmt.Printf("ChainWork: %#x\n", blockData.ChainWork)
+
+    pow := NewProofOfWork(blockData)
+    fmt.Printf("IsValid: %v\n", pow.IsValid(blockChain.NextDifficulty(blockData.PrevHash)))
+}
@@ -0,0 +1,173 @@
+package block
+
+import (
+    "fmt"
+    "math/rand"
+    "sort"
+    "strings"
+    "time"
+)
+
+// 选币策略
+// 转账时从付款人的 UTXO 中选出足够支付金额和手续费的 output
+
+// 选币策略的名称
+const CoinSelectLargest = "largest"
+const CoinSelectSmallest = "smallest"
+const CoinSelectBnB = "bnb"
+const CoinSelectRandom = "random"
+
+// 默认的选币策略
+const DefaultCoinSelection = CoinSelectLargest
+
+// 分支限界法最多尝试的次数，超过时放弃精确匹配
+const bnbMaxTries = 100000
+
+// 选币策略接口
+// 从可用的 UTXO 中选出总金额不小于 amount 的 UTXO，金额不足时返回 nil
+type CoinSelector interface {
+    Select(UTXOInfos []UTXOInfo, amount int64) []UTXOInfo
+}
+
+// 选币参数
+type CoinSelection struct {
+    Selector CoinSelector // 选币策略，为空时使用默认策略
+    Pinned   []string     // 手动指定的 UTXO，格式为 交易id:索引，总是作为 input
+}
+
+// 根据名称获取选币策略
+func NewCoinSelector(name string) (CoinSelector, error) {
+    switch name {
+        case CoinSelectLargest:
+            return LargestFirstSelector{}, nil
+        case CoinSelectSmallest:
+            return SmallestFirstSelector{}, nil
+        case CoinSelectBnB:
+            return BranchAndBoundSelector{}, nil
+        case CoinSelectRandom:
+            return RandomSelector{rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+    }
+    return nil, fmt.Errorf("未知的选币策略 %s", name)
+}
+
+// 解析手动指定的 UTXO，多个 UTXO 使用逗号分隔
+func ParsePinnedUTXOs(str string) ([]string, error) {
+    var pinned []string
+    for _, item := range strings.Split(str, ",") {
+        item = strings.ToLower(strings.TrimSpace(item))
+        if item == "" {
+            continue
+        }
+        var txId []byte
+        var index int
+        _, err := fmt.Sscanf(item, "%x:%d", &txId, &index)
+        if err != nil || outPointKey(txId, index) != item {
+            return nil, fmt.Errorf("UTXO %s 格式错误, 应为 交易id:索引", item)
+        }
+        pinned = append(pinned, item)
+    }
+    return pinned, nil
+}
+
+// 按照顺序累加，直到金额足够
+func accumulate(UTXOInfos []UTXOInfo, amount int64) []UTXOInfo {
+    var selected []UTXOInfo
+    var total int64
+    for _, UTXOInfo := range UTXOInfos {
+        if total >= amount {
+            break
+        }
+        selected = append(selected, UTXOInfo)
+        total += UTXOInfo.Output.Value
+    }
+    if total < amount {
+        return nil
+    }
+    return selected
+}
+
+// 按照金额从大到小排序
+func sortByValueDesc(UTXOInfos []UTXOInfo) []UTXOInfo {
+    sorted := append([]UTXOInfo{}, UTXOInfos...)
+    sort.SliceStable(sorted, func(i, j int) bool {
+        return sorted[i].Output.Value > sorted[j].Output.Value
+    })
+    return sorted
+}
+
+// 大额优先，使用的 input 最少，交易最小
+type LargestFirstSelector struct{}
+
+func (LargestFirstSelector) Select(UTXOInfos []UTXOInfo, amount int64) []UTXOInfo {
+    return accumulate(sortByValueDesc(UTXOInfos), amount)
+}
+
+// 小额优先，合并零散的 UTXO
+type SmallestFirstSelector struct{}
+
+func (SmallestFirstSelector) Select(UTXOInfos []UTXOInfo, amount int64) []UTXOInfo {
+    sorted := append([]UTXOInfo{}, UTXOInfos...)
+    sort.SliceStable(sorted, func(i, j int) bool {
+        return sorted[i].Output.Value < sorted[j].Output.Value
+    })
+    return accumulate(sorted, amount)
+}
+
+// 分支限界法，查找总金额正好等于 amount 的组合，不产生找零
+// 没有找到时使用大额优先
+type BranchAndBoundSelector struct{}
+
+func (BranchAndBoundSelector) Select(UTXOInfos []UTXOInfo, amount int64) []UTXOInfo {
+    sorted := sortByValueDesc(UTXOInfos)
+    // remaining[i] 为 sorted[i:] 的总金额，用于剪枝
+    remaining := make([]int64, len(sorted)+1)
+    for i := len(sorted) - 1 ; i >= 0 ; i-- {
+        remaining[i] = remaining[i+1] + sorted[i].Output.Value
+    }
+
+    var selected []int
+    tries := 0
+    var search func(i int, total int64) bool
+    search = func(i int, total int64) bool {
+        tries++
+        if total == amount {
+            return true
+        }
+        if total > amount || i == len(sorted) || total + remaining[i] < amount || tries > bnbMaxTries {
+            return false
+        }
+        // 先尝试包含第 i 个 UTXO，再尝试不包含
+        selected = append(selected, i)
+        if search(i+1, total + sorted[i].Output.Value) {
+            return true
+        }
+        selected = selected[:len(selected)-1]
+        return search(i+1, total)
+    }
+    if amount > 0 && search(0, 0) {
+        var result []UTXOInfo
+        for _, i := range selected {
+            result = append(result, sorted[i])
+        }
+        return result
+    }
+    return accumulate(sorted, amount)
+}
+
+// 随机选择，避免总是使用相同的 UTXO 暴露钱包的结构
+type RandomSelector struct {
+    random *rand.Rand
+}
+
+func (selector RandomSelector) Select(UTXOInfos []UTXOInfo, amount int64) []UTXOInfo {
+    shuffled := append([]UTXOInfo{}, UTXOInfos...)
+    swap := func(i, j int) {
+        shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+    }
+    if selector.random == nil {
+        rand.Shuffle(len(shuffled), swap)
+    } else {
+        selector.random.Shuffle(len(shuffled), swap)
+    }
+    return accumulate(shuffled, amount)
+}
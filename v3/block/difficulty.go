@@ -0,0 +1,148 @@
+package block
+
+import (
+    "math/big"
+)
+
+// 难度调整
+// 每隔 RetargetInterval 个区块，根据这段时间内实际的出块时间重新计算目标值
+// 目标值使用比特币的压缩格式（nBits）保存在区块的 Difficulty 字段中
+
+// 每隔多少个区块调整一次难度
+const RetargetInterval = 10
+
+// 期望的出块时间（秒）
+const TargetBlockTime = 10
+
+// 单次调整的最大倍数
+const maxRetargetFactor = 4
+
+// 最低难度，目标值不能大于 1 << (256 - MinBits)
+const MinBits = 8
+
+// 最低难度对应的目标值
+var powLimit = new(big.Int).Lsh(big.NewInt(1), 256-MinBits)
+
+// 创世块使用的难度值，由 Bits 推导
+var InitialDifficulty = BigToCompact(new(big.Int).Lsh(big.NewInt(1), 256-Bits))
+
+// 将压缩格式转换成目标值
+// 最高字节为指数，低 3 个字节为尾数，目标值 = 尾数 * 256^(指数-3)
+func CompactToBig(compact uint64) *big.Int {
+    mantissa := compact & 0x007fffff
+    isNegative := compact&0x00800000 != 0
+    exponent := uint(compact >> 24)
+
+    var target *big.Int
+    if exponent <= 3 {
+        mantissa >>= 8 * (3 - exponent)
+        target = new(big.Int).SetUint64(mantissa)
+    } else {
+        target = new(big.Int).SetUint64(mantissa)
+        target.Lsh(target, 8*(exponent-3))
+    }
+    if isNegative {
+        target = target.Neg(target)
+    }
+    return target
+}
+
+// 将目标值转换成压缩格式
+func BigToCompact(target *big.Int) uint64 {
+    if target.Sign() == 0 {
+        return 0
+    }
+
+    var mantissa uint64
+    exponent := uint(len(target.Bytes()))
+    if exponent <= 3 {
+        mantissa = target.Uint64()
+        mantissa <<= 8 * (3 - exponent)
+    } else {
+        tmp := new(big.Int).Rsh(target, 8*(exponent-3))
+        mantissa = tmp.Uint64()
+    }
+
+    // 尾数的最高位是符号位，需要时增加指数
+    if mantissa&0x00800000 != 0 {
+        mantissa >>= 8
+        exponent++
+    }
+    return uint64(exponent<<24) | mantissa
+}
+
+// 将区块中的难度值转换成目标值
+// 旧版本的区块直接保存前导 0 的位数（如 16），没有指数部分
+func DifficultyToTarget(difficulty uint64) *big.Int {
+    if difficulty>>24 == 0 {
+        if difficulty > 256 {
+            return big.NewInt(0)
+        }
+        return new(big.Int).Lsh(big.NewInt(1), uint(256-difficulty))
+    }
+    return CompactToBig(difficulty)
+}
+
+// 判断两个难度值对应的目标值是否相同
+// 旧版本的区块使用前导 0 的位数，与压缩格式的值不同但目标值相同
+func SameDifficulty(a, b uint64) bool {
+    return DifficultyToTarget(a).Cmp(DifficultyToTarget(b)) == 0
+}
+
+// 根据实际用时调整难度
+// actualTimespan 为这一段区块实际用时，expectedTimespan 为期望用时
+func CalculateDifficulty(prevDifficulty uint64, actualTimespan, expectedTimespan int64) uint64 {
+    // 限制单次调整的幅度
+    if actualTimespan < expectedTimespan/maxRetargetFactor {
+        actualTimespan = expectedTimespan / maxRetargetFactor
+    }
+    if actualTimespan > expectedTimespan*maxRetargetFactor {
+        actualTimespan = expectedTimespan * maxRetargetFactor
+    }
+
+    // 新目标值 = 旧目标值 * 实际用时 / 期望用时
+    target := DifficultyToTarget(prevDifficulty)
+    target.Mul(target, big.NewInt(actualTimespan))
+    target.Div(target, big.NewInt(expectedTimespan))
+
+    if target.Cmp(powLimit) > 0 {
+        target.Set(powLimit)
+    }
+    return BigToCompact(target)
+}
+
+// 计算下一个区块的难度值
+// prevHash 为下一个区块的前一个区块 hash
+func (blockChain *BlockChain) NextDifficulty(prevHash []byte) uint64 {
+    prevBlock := blockChain.GetBlockByHash(prevHash)
+    // 创世块
+    if prevBlock == nil {
+        return InitialDifficulty
+    }
+
+    height := blockChain.blockHeight(prevBlock) + 1
+    // 不需要调整难度，使用前一个区块的难度
+    if height%RetargetInterval != 0 {
+        return prevBlock.Difficulty
+    }
+
+    // 找到这一段区块中的第一个区块
+    firstBlock := prevBlock
+    for i := 0; i < RetargetInterval-1; i++ {
+        firstBlock = blockChain.GetBlockByHash(firstBlock.PrevHash)
+    }
+
+    actualTimespan := int64(prevBlock.Timestamp) - int64(firstBlock.Timestamp)
+    expectedTimespan := int64((RetargetInterval - 1) * TargetBlockTime)
+    return CalculateDifficulty(prevBlock.Difficulty, actualTimespan, expectedTimespan)
+}
+
+// 计算区块高度，创世块高度为 0
+// 区块还没有存入数据库时，使用前一个区块的高度计算
+func (blockChain *BlockChain) blockHeight(block *Block) int {
+    prevBlock := blockChain.GetBlockByHash(block.PrevHash)
+    if prevBlock == nil {
+        return 0
+    }
+    return int(prevBlock.Height) + 1
+}
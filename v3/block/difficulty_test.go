@@ -0,0 +1,100 @@
+package block
+
+import (
+    "math/big"
+    "testing"
+)
+
+// 解析十六进制的目标值
+func hexToBig(t *testing.T, str string) *big.Int {
+    n, ok := new(big.Int).SetString(str, 16)
+    if !ok {
+        t.Fatalf("无效的十六进制数 %s", str)
+    }
+    return n
+}
+
+func TestCompact(t *testing.T) {
+    tests := []struct {
+        compact   uint64
+        target    string
+        roundTrip bool // 压缩格式是否为规范格式，转换回来后不变
+    }{
+        {0x00000000, "0", true},
+        {0x01003456, "0", false},
+        {0x01123456, "12", false},
+        {0x01120000, "12", true},
+        {0x02008000, "80", true},
+        {0x02123456, "1234", false},
+        {0x03123456, "123456", true},
+        {0x04123456, "12345600", true},
+        {0x04923456, "-12345600", true},
+        {0x05009234, "92340000", true},
+        {0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000", true},
+        {0x1b0404cb, "404cb000000000000000000000000000000000000000000000000", true},
+        {0x20123456, "1234560000000000000000000000000000000000000000000000000000000000", true},
+    }
+    for _, test := range tests {
+        want := hexToBig(t, test.target)
+        target := CompactToBig(test.compact)
+        if target.Cmp(want) != 0 {
+            t.Errorf("CompactToBig(%#08x) = %x, want %x", test.compact, target, want)
+        }
+        if !test.roundTrip || want.Sign() < 0 {
+            continue
+        }
+        if compact := BigToCompact(want); compact != test.compact {
+            t.Errorf("BigToCompact(%x) = %#08x, want %#08x", want, compact, test.compact)
+        }
+    }
+}
+
+func TestDifficultyToTarget(t *testing.T) {
+    tests := []struct {
+        difficulty uint64
+        want       *big.Int
+    }{
+        // 旧版本的区块保存前导 0 的位数
+        {16, new(big.Int).Lsh(big.NewInt(1), 240)},
+        {256, big.NewInt(1)},
+        {300, big.NewInt(0)},
+        {InitialDifficulty, new(big.Int).Lsh(big.NewInt(1), 256-Bits)},
+        {0x1d00ffff, new(big.Int).Lsh(big.NewInt(0xffff), 208)},
+    }
+    for _, test := range tests {
+        if target := DifficultyToTarget(test.difficulty); target.Cmp(test.want) != 0 {
+            t.Errorf("DifficultyToTarget(%#x) = %x, want %x", test.difficulty, target, test.want)
+        }
+    }
+    if !SameDifficulty(Bits, InitialDifficulty) {
+        t.Errorf("SameDifficulty(%d, %#x) = false, want true", Bits, InitialDifficulty)
+    }
+}
+
+func TestCalculateDifficulty(t *testing.T) {
+    // 期望用时取 4 的倍数，限制幅度时正好为 4 倍
+    expected := int64(100)
+    target := DifficultyToTarget(InitialDifficulty)
+    tests := []struct {
+        name   string
+        actual int64
+        want   *big.Int
+    }{
+        {"用时与期望相同", expected, target},
+        {"用时减半", expected / 2, new(big.Int).Rsh(target, 1)},
+        {"用时过短时最多调整 4 倍", 0, new(big.Int).Rsh(target, 2)},
+        {"用时加倍", expected * 2, new(big.Int).Lsh(target, 1)},
+        {"用时过长时最多调整 4 倍", expected * 100, new(big.Int).Lsh(target, 2)},
+    }
+    for _, test := range tests {
+        difficulty := CalculateDifficulty(InitialDifficulty, test.actual, expected)
+        if got := DifficultyToTarget(difficulty); got.Cmp(test.want) != 0 {
+            t.Errorf("%s: 目标值为 %x, want %x", test.name, got, test.want)
+        }
+    }
+
+    // 目标值不能超过最低难度
+    if got := DifficultyToTarget(CalculateDifficulty(BigToCompact(powLimit), expected*4, expected)); got.Cmp(powLimit) != 0 {
+        t.Errorf("目标值为 %x, 超过最低难度 %x", got, powLimit)
+    }
+}
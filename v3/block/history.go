@@ -0,0 +1,100 @@
+package block
+
+import (
+    "bytes"
+)
+
+// 交易记录的类型
+const HistoryReceived = "收款"
+const HistorySent = "付款"
+const HistorySelf = "自己转账"
+
+// 挖矿奖励的对方
+const historyCoinBase = "挖矿奖励"
+
+// 地址的一条交易记录
+type HistoryEntry struct {
+    Height         uint64   // 交易所在的区块高度
+    Timestamp      uint64   // 区块时间戳
+    TxId           []byte   // 交易 id
+    Direction      string   // 收款、付款或自己转账
+    Amount         int64    // 地址的净金额，付款时为负数，包括手续费
+    Counterparties []string // 对方地址，收款时为付款人，付款时为收款人
+    Balance        int64    // 该交易之后地址的余额
+}
+
+// 获取地址在主链上的交易记录，按照从创世块开始的顺序
+func (blockChain *BlockChain) History(address string) []*HistoryEntry {
+    publicKeyHash := Lock(address)
+
+    var blocks []*Block
+    it := blockChain.Iterator()
+    for block := it.Next() ; block != nil ; block = it.Next() {
+        blocks = append([]*Block{block}, blocks...)
+    }
+
+    // 属于该地址的 output，交易 id + 索引 => 金额
+    myOutputs := make(map[string]int64)
+    var history []*HistoryEntry
+    var balance int64
+    for _, block := range blocks {
+        for _, tx := range block.Transactions {
+            if !isRelatedTransaction(tx, publicKeyHash) {
+                continue
+            }
+            var received, sent int64
+            var senders, receivers []string
+            if tx.IsCoinBase() {
+                senders = append(senders, historyCoinBase)
+            } else {
+                for _, input := range tx.TxInputs {
+                    key := outPointKey(input.TxId, input.Index)
+                    if value, ok := myOutputs[key]; ok {
+                        sent += value
+                        delete(myOutputs, key)
+                        continue
+                    }
+                    senders = appendUnique(senders, input.Address())
+                }
+            }
+            for i, output := range tx.TxOutputs {
+                if bytes.Equal(output.LockedHash(), publicKeyHash) {
+                    received += output.Value
+                    myOutputs[outPointKey(tx.TxId, i)] = output.Value
+                    continue
+                }
+                receivers = appendUnique(receivers, output.Address())
+            }
+
+            entry := &HistoryEntry{
+                Height:    block.Height,
+                Timestamp: block.Timestamp,
+                TxId:      tx.TxId,
+                Amount:    received - sent,
+            }
+            switch {
+                case sent == 0:
+                    entry.Direction = HistoryReceived
+                    entry.Counterparties = senders
+                case len(receivers) == 0:
+                    entry.Direction = HistorySelf
+                default:
+                    entry.Direction = HistorySent
+                    entry.Counterparties = receivers
+            }
+            balance += entry.Amount
+            entry.Balance = balance
+            history = append(history, entry)
+        }
+    }
+    return history
+}
+
+func appendUnique(list []string, value string) []string {
+    for _, item := range list {
+        if item == value {
+            return list
+        }
+    }
+    return append(list, value)
+}
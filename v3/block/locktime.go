@@ -0,0 +1,180 @@
+package block
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// 交易的锁定时间和 input 的相对锁定时间（类似比特币的 nLockTime 和 BIP68）
+// 锁定时间小于 LockTimeThreshold 时为区块高度，否则为 Unix 时间戳，交易只能打包进高度或时间戳大于锁定时间的区块
+// 所有 input 的序列号都为 MaxSequence 时锁定时间不生效
+// 序列号没有设置 SequenceLockTimeDisableFlag 时为相对锁定时间，引用的 output 所在的区块之后经过指定的区块数或时间，交易才能打包
+
+// 小于该值的锁定时间为区块高度
+const LockTimeThreshold = 500000000
+
+// input 序列号的最大值，所有 input 都使用最大值时交易的锁定时间不生效
+const MaxSequence = 0xffffffff
+
+// 设置后序列号不表示相对锁定时间
+const SequenceLockTimeDisableFlag = 1 << 31
+
+// 设置后相对锁定时间的单位为 512 秒，否则为区块数
+const SequenceLockTimeTypeFlag = 1 << 22
+
+// 序列号中相对锁定时间的数值
+const SequenceLockTimeMask = 0x0000ffff
+
+// 相对锁定时间的单位为 2^9 = 512 秒
+const SequenceLockTimeGranularity = 9
+
+// 时间格式，锁定时间可以使用本地时间
+const lockTimeLayout = "2006-01-02 15:04:05"
+
+// 创建交易时的时间锁
+type TimeLock struct {
+    LockTime uint64 // 交易的锁定时间，为 0 时没有锁定时间
+    Sequence uint32 // 所有 input 的序列号
+}
+
+// 创建时间锁，lockTime 为交易的锁定时间，relativeLockTime 为 input 的相对锁定时间，都为空时不锁定
+func NewTimeLock(lockTime, relativeLockTime string) (*TimeLock, error) {
+    timeLock := &TimeLock{Sequence: MaxSequence}
+    if lockTime != "" {
+        var err error
+        timeLock.LockTime, err = ParseLockTime(lockTime)
+        if err != nil {
+            return nil, err
+        }
+        // 锁定时间只有在存在不是最大值的序列号时才生效
+        timeLock.Sequence = MaxSequence - 1
+    }
+    if relativeLockTime != "" {
+        var err error
+        timeLock.Sequence, err = ParseRelativeLockTime(relativeLockTime)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return timeLock, nil
+}
+
+// 解析锁定时间，参数为区块高度、Unix 时间戳或本地时间（2006-01-02 15:04:05）
+func ParseLockTime(str string) (uint64, error) {
+    str = strings.TrimSpace(str)
+    if lockTime, err := strconv.ParseUint(str, 10, 64); err == nil {
+        return lockTime, nil
+    }
+    t, err := time.ParseInLocation(lockTimeLayout, str, time.Local)
+    if err != nil || t.Unix() < LockTimeThreshold {
+        return 0, fmt.Errorf("锁定时间 %s 格式错误, 应为区块高度、Unix 时间戳或 %s", str, lockTimeLayout)
+    }
+    return uint64(t.Unix()), nil
+}
+
+// 解析相对锁定时间，参数为区块数，或者以 s 结尾的秒数（按照 512 秒向上取整），返回序列号
+func ParseRelativeLockTime(str string) (uint32, error) {
+    str = strings.TrimSpace(str)
+    seconds := strings.HasSuffix(str, "s")
+    value, err := strconv.ParseUint(strings.TrimSuffix(str, "s"), 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("相对锁定时间 %s 格式错误, 应为区块数或以 s 结尾的秒数", str)
+    }
+    if !seconds {
+        if value > SequenceLockTimeMask {
+            return 0, fmt.Errorf("相对锁定时间不能超过 %d 个区块", SequenceLockTimeMask)
+        }
+        return uint32(value), nil
+    }
+    units := (value + 1<<SequenceLockTimeGranularity - 1) >> SequenceLockTimeGranularity
+    if units > SequenceLockTimeMask {
+        return 0, fmt.Errorf("相对锁定时间不能超过 %d 秒", SequenceLockTimeMask<<SequenceLockTimeGranularity)
+    }
+    return SequenceLockTimeTypeFlag | uint32(units), nil
+}
+
+// 显示锁定时间
+func FormatLockTime(lockTime uint64) string {
+    if lockTime < LockTimeThreshold {
+        return fmt.Sprintf("区块高度 %d", lockTime)
+    }
+    return time.Unix(int64(lockTime), 0).Format(lockTimeLayout)
+}
+
+// 显示序列号表示的相对锁定时间，没有相对锁定时间时返回空字符串
+func formatSequence(sequence uint32) string {
+    if sequence & SequenceLockTimeDisableFlag != 0 {
+        return ""
+    }
+    value := sequence & SequenceLockTimeMask
+    if sequence & SequenceLockTimeTypeFlag != 0 {
+        return fmt.Sprintf("%d 秒", value<<SequenceLockTimeGranularity)
+    }
+    return fmt.Sprintf("%d 个区块", value)
+}
+
+// 判断交易在高度为 height、时间戳为 timestamp 的区块中是否已经到了锁定时间
+func (tx *Transaction) IsFinal(height, timestamp uint64) bool {
+    if tx.LockTime == 0 {
+        return true
+    }
+    limit := height
+    if tx.LockTime >= LockTimeThreshold {
+        limit = timestamp
+    }
+    if tx.LockTime < limit {
+        return true
+    }
+    for _, input := range tx.TxInputs {
+        if input.Sequence != MaxSequence {
+            return false
+        }
+    }
+    return true
+}
+
+// 检查交易能否打包进高度为 height、时间戳为 timestamp 的区块
+// prevBlocks 为 input 引用的交易所在的区块，键为交易 id
+func (tx *Transaction) CheckLockTime(height, timestamp uint64, prevBlocks map[string]*Block) error {
+    if !tx.IsFinal(height, timestamp) {
+        return fmt.Errorf("交易的锁定时间 %s 未到", FormatLockTime(tx.LockTime))
+    }
+    // 只有新版本的交易使用相对锁定时间
+    if tx.Version < TxVersion || tx.IsCoinBase() {
+        return nil
+    }
+    for i, input := range tx.TxInputs {
+        if input.Sequence & SequenceLockTimeDisableFlag != 0 {
+            continue
+        }
+        prevBlock := prevBlocks[string(input.TxId)]
+        if prevBlock == nil {
+            return fmt.Errorf("未找到 input %d 引用的交易所在的区块", i)
+        }
+        value := uint64(input.Sequence & SequenceLockTimeMask)
+        if input.Sequence & SequenceLockTimeTypeFlag != 0 {
+            if need := prevBlock.Timestamp + value<<SequenceLockTimeGranularity; timestamp < need {
+                return fmt.Errorf("input %d 的相对锁定时间未到, 区块时间需要不早于 %s", i, FormatLockTime(need))
+            }
+        } else if need := prevBlock.Height + value; height < need {
+            return fmt.Errorf("input %d 的相对锁定时间未到, 区块高度需要不小于 %d", i, need)
+        }
+    }
+    return nil
+}
+
+// 检查交易能否打包进高度为 height、时间戳为 timestamp 的区块，input 引用的交易必须在主链上
+func (blockChain *BlockChain) CheckLockTime(tx *Transaction, height, timestamp uint64) error {
+    prevBlocks := make(map[string]*Block)
+    for _, input := range tx.TxInputs {
+        if _, ok := prevBlocks[string(input.TxId)]; ok || tx.IsCoinBase() {
+            continue
+        }
+        if _, block := blockChain.GetTransaction(input.TxId); block != nil {
+            prevBlocks[string(input.TxId)] = block
+        }
+    }
+    return tx.CheckLockTime(height, timestamp, prevBlocks)
+}
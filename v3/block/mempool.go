@@ -0,0 +1,347 @@
+package block
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/boltdb/bolt"
+    "log"
+    "sync"
+)
+
+// 交易池使用的 Bucket
+// key 为交易 id，value 为交易
+const MempoolBucketName = "mempool_bucket"
+
+// 交易池
+// 保存等待打包的交易，矿工从交易池中取出交易打包成区块
+type Mempool struct {
+    blockChain *BlockChain
+    persist    bool                    // 是否保存到数据库
+    txs        map[string]*Transaction // txId => 交易
+    order      []string                // 交易加入交易池的顺序
+    spent      map[string][]byte       // 被交易池中交易引用的 output => 引用它的交易 id
+    lock       sync.Mutex
+}
+
+// output 的 key
+func outPointKey(txId []byte, index int) string {
+    return fmt.Sprintf("%x:%d", txId, index)
+}
+
+// 创建交易池
+// persist 为 true 时，交易池保存到数据库中，并加载之前保存的交易
+func NewMempool(blockChain *BlockChain, persist bool) *Mempool {
+    pool := &Mempool{
+        blockChain: blockChain,
+        persist:    persist,
+        txs:        make(map[string]*Transaction),
+        spent:      make(map[string][]byte),
+    }
+    if !persist {
+        return pool
+    }
+
+    pool.load()
+    return pool
+}
+
+// 加载数据库中保存的交易，重新校验，删除已经上链或者失效的交易
+func (pool *Mempool) load() {
+    var txs []*Transaction
+    err := pool.blockChain.boltDB.Update(func(tx *bolt.Tx) error {
+        bucket, err := tx.CreateBucketIfNotExists([]byte(MempoolBucketName))
+        if err != nil {
+            return err
+        }
+        return bucket.ForEach(func(key, value []byte) error {
+            if _, ok := pool.txs[string(key)]; ok {
+                return nil
+            }
+            transaction := &Transaction{}
+            transaction.ToTransaction(value)
+            txs = append(txs, transaction)
+            return nil
+        })
+    })
+    if err != nil {
+        log.Panic(err)
+    }
+
+    for _, tx := range txs {
+        if err := pool.check(tx); err != nil {
+            fmt.Printf("删除失效的交易 %x: %v\n", tx.TxId, err)
+            pool.deleteFromDB(tx.TxId)
+            continue
+        }
+        pool.add(tx)
+    }
+}
+
+// 重新加载数据库中新增的交易，例如链重组时放回交易池的交易
+func (pool *Mempool) Reload() {
+    if !pool.persist {
+        return
+    }
+    pool.lock.Lock()
+    defer pool.lock.Unlock()
+    pool.load()
+}
+
+// 检查交易是否可以加入交易池
+// 1.不能是挖矿交易，至少有一个 input 和一个 output
+// 2.不能已经在交易池中
+// 3.引用的 output 必须在 UTXO 集合中，并且没有被交易池中的其他交易引用
+// 4.输出金额不大于输入金额
+// 5.签名校验通过
+func (pool *Mempool) check(tx *Transaction) error {
+    if tx.IsCoinBase() {
+        return fmt.Errorf("挖矿交易不能加入交易池")
+    }
+    // 没有 input 时签名校验和金额检查都会通过
+    if len(tx.TxInputs) == 0 || len(tx.TxOutputs) == 0 {
+        return fmt.Errorf("交易没有 input 或 output")
+    }
+    if _, ok := pool.txs[string(tx.TxId)]; ok {
+        return fmt.Errorf("交易已在交易池中")
+    }
+    if !bytes.Equal(tx.CalculateTxID(), tx.TxId) {
+        return fmt.Errorf("交易 id 与内容不一致")
+    }
+
+    used := make(map[string]bool)
+    for _, input := range tx.TxInputs {
+        key := outPointKey(input.TxId, input.Index)
+        if used[key] {
+            return fmt.Errorf("交易重复引用 output %s", key)
+        }
+        used[key] = true
+
+        if _, ok := pool.blockChain.GetUTXO(input.TxId, input.Index); !ok {
+            return fmt.Errorf("output %s 不存在或已被花费", key)
+        }
+        if spender, ok := pool.spent[key]; ok {
+            return fmt.Errorf("output %s 已被交易池中的交易 %x 引用", key, spender)
+        }
+    }
+
+    // 输出金额不能大于输入金额
+    if _, err := pool.blockChain.TransactionFee(tx); err != nil {
+        return err
+    }
+
+    if !pool.blockChain.VerifyTransaction(tx) {
+        return fmt.Errorf("签名校验失败")
+    }
+    return nil
+}
+
+// 将交易加入内存
+func (pool *Mempool) add(tx *Transaction) {
+    key := string(tx.TxId)
+    pool.txs[key] = tx
+    pool.order = append(pool.order, key)
+    for _, input := range tx.TxInputs {
+        pool.spent[outPointKey(input.TxId, input.Index)] = tx.TxId
+    }
+}
+
+// 将交易从内存中删除
+func (pool *Mempool) remove(txId []byte) {
+    key := string(txId)
+    tx, ok := pool.txs[key]
+    if !ok {
+        return
+    }
+    delete(pool.txs, key)
+    for i, k := range pool.order {
+        if k == key {
+            pool.order = append(pool.order[:i], pool.order[i+1:]...)
+            break
+        }
+    }
+    for _, input := range tx.TxInputs {
+        delete(pool.spent, outPointKey(input.TxId, input.Index))
+    }
+}
+
+func (pool *Mempool) saveToDB(tx *Transaction) {
+    if !pool.persist {
+        return
+    }
+    err := pool.blockChain.boltDB.Update(func(boltTx *bolt.Tx) error {
+        bucket := boltTx.Bucket([]byte(MempoolBucketName))
+        return bucket.Put(tx.TxId, tx.ToBytes())
+    })
+    if err != nil {
+        log.Panic(err)
+    }
+}
+
+func (pool *Mempool) deleteFromDB(txIds ...[]byte) {
+    if !pool.persist || len(txIds) == 0 {
+        return
+    }
+    err := pool.blockChain.boltDB.Update(func(boltTx *bolt.Tx) error {
+        bucket := boltTx.Bucket([]byte(MempoolBucketName))
+        for _, txId := range txIds {
+            err := bucket.Delete(txId)
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        log.Panic(err)
+    }
+}
+
+// 将签名后的交易加入交易池
+func (pool *Mempool) Add(tx *Transaction) error {
+    pool.lock.Lock()
+    defer pool.lock.Unlock()
+
+    err := pool.check(tx)
+    if err != nil {
+        return err
+    }
+    pool.add(tx)
+    pool.saveToDB(tx)
+    return nil
+}
+
+// 判断交易是否在交易池中
+func (pool *Mempool) Has(txId []byte) bool {
+    return pool.Get(txId) != nil
+}
+
+// 根据交易 id 获取交易
+func (pool *Mempool) Get(txId []byte) *Transaction {
+    pool.lock.Lock()
+    defer pool.lock.Unlock()
+    return pool.txs[string(txId)]
+}
+
+// 交易池中的交易数
+func (pool *Mempool) Count() int {
+    pool.lock.Lock()
+    defer pool.lock.Unlock()
+    return len(pool.txs)
+}
+
+// 按照加入顺序返回交易池中的所有交易
+func (pool *Mempool) Transactions() []*Transaction {
+    pool.lock.Lock()
+    defer pool.lock.Unlock()
+    var txs []*Transaction
+    for _, key := range pool.order {
+        txs = append(txs, pool.txs[key])
+    }
+    return txs
+}
+
+// 取出交易池中的所有交易，并清空交易池
+func (pool *Mempool) Drain() []*Transaction {
+    pool.lock.Lock()
+    defer pool.lock.Unlock()
+
+    var txs []*Transaction
+    var txIds [][]byte
+    for _, key := range pool.order {
+        txs = append(txs, pool.txs[key])
+        txIds = append(txIds, []byte(key))
+    }
+    pool.txs = make(map[string]*Transaction)
+    pool.order = nil
+    pool.spent = make(map[string][]byte)
+    pool.deleteFromDB(txIds...)
+    return txs
+}
+
+// 区块上链后，删除区块中的交易，以及与区块中交易冲突的交易
+func (pool *Mempool) RemoveBlockTransactions(block *Block) {
+    pool.lock.Lock()
+    defer pool.lock.Unlock()
+
+    var txIds [][]byte
+    for _, tx := range block.Transactions {
+        if _, ok := pool.txs[string(tx.TxId)]; ok {
+            pool.remove(tx.TxId)
+            txIds = append(txIds, tx.TxId)
+        }
+        if tx.IsCoinBase() {
+            continue
+        }
+        // 引用了同一个 output 的交易已经失效
+        for _, input := range tx.TxInputs {
+            spender, ok := pool.spent[outPointKey(input.TxId, input.Index)]
+            if ok {
+                pool.remove(spender)
+                txIds = append(txIds, spender)
+            }
+        }
+    }
+    pool.deleteFromDB(txIds...)
+}
+
+// 读取数据库中交易池引用的 output
+// 创建交易时跳过这些 output，避免与交易池中的交易冲突
+func (blockChain *BlockChain) pendingSpentOutputs() map[string]bool {
+    spent := make(map[string]bool)
+    blockChain.view(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket([]byte(MempoolBucketName))
+        if bucket == nil {
+            return nil
+        }
+        return bucket.ForEach(func(key, value []byte) error {
+            transaction := &Transaction{}
+            transaction.ToTransaction(value)
+            for _, input := range transaction.TxInputs {
+                spent[outPointKey(input.TxId, input.Index)] = true
+            }
+            return nil
+        })
+    })
+    return spent
+}
+
+// 将交易池中的交易打包成区块
+// 矿工获得区块中所有交易的手续费
+// 未到锁定时间的交易留在交易池中，之后再打包
+// 区块上链后删除交易池中已打包和冲突的交易
+func (blockChain *BlockChain) MineBlock(miner string, pool *Mempool) (*Block, error) {
+    var txs []*Transaction
+    var fees int64
+    height := uint64(blockChain.Height() + 1)
+    timestamp := blockChain.nextTimestamp()
+    for _, tx := range pool.Transactions() {
+        if err := blockChain.CheckLockTime(tx, height, timestamp); err != nil {
+            fmt.Printf("交易 %x 暂不打包: %v\n", tx.TxId, err)
+            continue
+        }
+        // 所有校验通过后才计入手续费，否则无效交易的手续费会留在挖矿交易中
+        fee, err := blockChain.TransactionFee(tx)
+        if err != nil || !blockChain.VerifyTransaction(tx) {
+            fmt.Printf("发现无效的交易: %x\n", tx.TxId)
+            continue
+        }
+        total, err := AddAmount(fees, fee)
+        if err != nil {
+            fmt.Printf("发现无效的交易: %x\n", tx.TxId)
+            continue
+        }
+        fees = total
+        txs = append(txs, tx)
+    }
+
+    // 创建挖矿交易
+    coinBase := NewCoinBaseTx(miner, firstData, BlockSubsidy(blockChain.params, blockChain.Height()+1) + fees)
+    txs = append([]*Transaction{coinBase}, txs...)
+
+    block, err := blockChain.AddBlock(txs)
+    if err != nil {
+        return nil, err
+    }
+    pool.RemoveBlockTransactions(block)
+    return block, nil
+}
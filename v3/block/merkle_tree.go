@@ -0,0 +1,125 @@
+package block
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "fmt"
+    "strings"
+)
+
+// 梅克尔树
+// 叶子节点为交易 id，父节点为两个子节点拼接后做两次 sha256
+// 某一层节点个数为奇数时，复制最后一个节点（与比特币一致）
+type MerkleTree struct {
+    Levels [][][]byte // 第 0 层为叶子节点，最后一层为根节点
+}
+
+// 梅克尔证明
+// 从叶子节点到根节点路径上每一层的兄弟节点
+type MerkleProof struct {
+    TxId   []byte   // 被证明的交易 id
+    Index  int      // 交易在区块中的位置
+    Hashes [][]byte // 兄弟节点 hash，从叶子层开始
+}
+
+// 两次 sha256
+func doubleSha256(data []byte) []byte {
+    firstHash := sha256.Sum256(data)
+    secondHash := sha256.Sum256(firstHash[:])
+    return secondHash[:]
+}
+
+// 计算父节点
+func hashMerkleNodes(left, right []byte) []byte {
+    data := make([]byte, 0, len(left)+len(right))
+    data = append(data, left...)
+    data = append(data, right...)
+    return doubleSha256(data)
+}
+
+// 创建梅克尔树
+func NewMerkleTree(leaves [][]byte) *MerkleTree {
+    tree := &MerkleTree{}
+    // 没有交易时，使用空数据的 hash 作为根节点
+    if len(leaves) == 0 {
+        tree.Levels = [][][]byte{{doubleSha256(nil)}}
+        return tree
+    }
+
+    level := make([][]byte, len(leaves))
+    copy(level, leaves)
+    tree.Levels = append(tree.Levels, level)
+
+    for len(level) > 1 {
+        var parents [][]byte
+        for i := 0; i < len(level); i += 2 {
+            left := level[i]
+            right := left
+            // 奇数个节点，复制最后一个节点
+            if i+1 < len(level) {
+                right = level[i+1]
+            }
+            parents = append(parents, hashMerkleNodes(left, right))
+        }
+        level = parents
+        tree.Levels = append(tree.Levels, level)
+    }
+    return tree
+}
+
+// 梅克尔根
+func (tree *MerkleTree) Root() []byte {
+    return tree.Levels[len(tree.Levels)-1][0]
+}
+
+// 生成第 index 个叶子节点的梅克尔证明
+func (tree *MerkleTree) Proof(index int) *MerkleProof {
+    leaves := tree.Levels[0]
+    if index < 0 || index >= len(leaves) {
+        return nil
+    }
+    proof := &MerkleProof{TxId: leaves[index], Index: index}
+    // 根节点没有兄弟节点
+    for _, level := range tree.Levels[:len(tree.Levels)-1] {
+        sibling := index ^ 1
+        if sibling >= len(level) {
+            // 奇数个节点，兄弟节点为自身
+            sibling = index
+        }
+        proof.Hashes = append(proof.Hashes, level[sibling])
+        index /= 2
+    }
+    return proof
+}
+
+// 根据证明计算梅克尔根
+func (proof *MerkleProof) ComputeRoot() []byte {
+    hash := proof.TxId
+    index := proof.Index
+    for _, sibling := range proof.Hashes {
+        if index%2 == 0 {
+            hash = hashMerkleNodes(hash, sibling)
+        } else {
+            hash = hashMerkleNodes(sibling, hash)
+        }
+        index /= 2
+    }
+    return hash
+}
+
+// 使用区块头校验梅克尔证明
+// 只需要区块头中的梅克尔根，不需要区块中的交易
+func (proof *MerkleProof) Verify(block *Block) bool {
+    return bytes.Equal(proof.ComputeRoot(), block.MerKleRoot)
+}
+
+// 定义 String 方法
+func (proof *MerkleProof) String() string {
+    var lines []string
+    lines = append(lines, fmt.Sprintf("MerkleProof %x:", proof.TxId))
+    lines = append(lines, fmt.Sprintf("  Index: %d", proof.Index))
+    for i, hash := range proof.Hashes {
+        lines = append(lines, fmt.Sprintf("  Hash %d: %x", i, hash))
+    }
+    return strings.Join(lines, "\n")
+}
@@ -0,0 +1,68 @@
+package block
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+)
+
+// 生成 n 个叶子节点
+func testLeaves(n int) [][]byte {
+    var leaves [][]byte
+    for i := 0; i < n; i++ {
+        leaves = append(leaves, doubleSha256([]byte(fmt.Sprintf("tx%d", i))))
+    }
+    return leaves
+}
+
+func TestMerkleTree(t *testing.T) {
+    leaves := testLeaves(7)
+    ab := hashMerkleNodes(leaves[0], leaves[1])
+    cc := hashMerkleNodes(leaves[2], leaves[2])
+    cd := hashMerkleNodes(leaves[2], leaves[3])
+    ee := hashMerkleNodes(leaves[4], leaves[4])
+    ef := hashMerkleNodes(leaves[4], leaves[5])
+    gg := hashMerkleNodes(leaves[6], leaves[6])
+    abcd := hashMerkleNodes(ab, cd)
+
+    tests := []struct {
+        name     string
+        leaves   [][]byte
+        wantRoot []byte
+    }{
+        {"没有交易", nil, doubleSha256(nil)},
+        {"1 个交易", leaves[:1], leaves[0]},
+        {"2 个交易", leaves[:2], ab},
+        // 奇数个节点时复制最后一个节点
+        {"3 个交易", leaves[:3], hashMerkleNodes(ab, cc)},
+        {"4 个交易", leaves[:4], abcd},
+        {"5 个交易", leaves[:5], hashMerkleNodes(abcd, hashMerkleNodes(ee, ee))},
+        {"6 个交易", leaves[:6], hashMerkleNodes(abcd, hashMerkleNodes(ef, ef))},
+        {"7 个交易", leaves[:7], hashMerkleNodes(abcd, hashMerkleNodes(ef, gg))},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            tree := NewMerkleTree(test.leaves)
+            root := tree.Root()
+            if !bytes.Equal(root, test.wantRoot) {
+                t.Fatalf("Root() = %x, want %x", root, test.wantRoot)
+            }
+
+            block := &Block{MerKleRoot: root}
+            for i := range test.leaves {
+                proof := tree.Proof(i)
+                if !proof.Verify(block) {
+                    t.Errorf("交易 %d 的梅克尔证明校验失败", i)
+                }
+                // 修改位置后证明无效，只有一个交易或与复制的节点交换时除外
+                proof.Index ^= 1
+                if len(test.leaves) > 1 && proof.Index < len(test.leaves) && proof.Verify(block) {
+                    t.Errorf("交易 %d 修改位置后梅克尔证明仍然有效", i)
+                }
+            }
+            if len(test.leaves) > 0 && (tree.Proof(len(test.leaves)) != nil || tree.Proof(-1) != nil) {
+                t.Errorf("超出范围的位置返回了梅克尔证明")
+            }
+        })
+    }
+}
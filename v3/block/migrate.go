@@ -0,0 +1,144 @@
+package block
+
+import (
+    "bytes"
+    "encoding/gob"
+    "fmt"
+    "github.com/boltdb/bolt"
+    "log"
+    "math"
+)
+
+// 金额单位，保存在 block_bucket 中
+// 旧版本的数据库没有这个 key，金额为 float64
+const AmountUnitKey = "amount_unit"
+const AmountUnitSatoshi = "satoshi"
+
+// 迁移时最后一个区块的 hash
+// 旧区块的交易 id 和签名是对 float64 金额计算的，迁移后无法重新计算，校验时跳过
+const LegacyHashKey = "legacy_block_hash"
+
+// 旧版本的区块结构，金额为 float64
+// gob 按照字段名解码，只需要字段名一致
+type legacyTxOutput struct {
+    Value         float64
+    PublicKeyHash []byte
+}
+
+type legacyTransaction struct {
+    TxId      []byte
+    TxInputs  []TxInput
+    TxOutputs []legacyTxOutput
+}
+
+type legacyBlock struct {
+    Version      uint64
+    PrevHash     []byte
+    MerKleRoot   []byte
+    Timestamp    uint64
+    Difficulty   uint64
+    Nonce        uint64
+    Transactions []*legacyTransaction
+    Hash         []byte
+}
+
+// 将旧版本的区块转换成新版本，区块 hash、交易 id 和签名保持不变
+func (legacy *legacyBlock) toBlock() *Block {
+    block := &Block{
+        Version:    legacy.Version,
+        PrevHash:   legacy.PrevHash,
+        MerKleRoot: legacy.MerKleRoot,
+        Timestamp:  legacy.Timestamp,
+        Difficulty: legacy.Difficulty,
+        Nonce:      legacy.Nonce,
+        Hash:       legacy.Hash,
+    }
+    for _, legacyTx := range legacy.Transactions {
+        tx := &Transaction{TxId: legacyTx.TxId, TxInputs: legacyTx.TxInputs}
+        for _, output := range legacyTx.TxOutputs {
+            // 四舍五入到聪
+            value := int64(math.Round(output.Value * SatoshiPerCoin))
+            tx.TxOutputs = append(tx.TxOutputs, TxOutput{Value: value, PublicKeyHash: output.PublicKeyHash})
+        }
+        block.Transactions = append(block.Transactions, tx)
+    }
+    return block
+}
+
+// 判断数据库是否需要迁移金额
+func needMigrateAmounts(bucket *bolt.Bucket) bool {
+    return bucket.Get([]byte(LastHashKey)) != nil && bucket.Get([]byte(AmountUnitKey)) == nil
+}
+
+// 将旧版本数据库中的 float64 金额迁移为聪
+// 1.逐个转换区块中的金额
+// 2.删除 UTXO 集合、索引、交易池和孤块池，之后打开区块链时重建 UTXO 集合和索引
+func MigrateAmounts() error {
+    db, err := bolt.Open(dbPath(), 0600, nil)
+    if err != nil {
+        return err
+    }
+    defer db.Close()
+
+    var count int
+    err = db.Update(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket([]byte(BucketName))
+        if bucket == nil {
+            return fmt.Errorf("区块链不存在")
+        }
+        if !needMigrateAmounts(bucket) {
+            return fmt.Errorf("数据库不需要迁移")
+        }
+
+        lastHash := copyBytes(bucket.Get([]byte(LastHashKey)))
+        for hash := lastHash; ; {
+            value := bucket.Get(hash)
+            if value == nil {
+                break
+            }
+            var legacy legacyBlock
+            decoder := gob.NewDecoder(bytes.NewReader(value))
+            err := decoder.Decode(&legacy)
+            if err != nil {
+                return fmt.Errorf("区块 %x 反序列化失败: %v", hash, err)
+            }
+            err = bucket.Put(hash, legacy.toBlock().ToBytes())
+            if err != nil {
+                return err
+            }
+            count++
+            hash = legacy.PrevHash
+        }
+
+        for _, name := range []string{UTXOBucketName, HeightBucketName, TxIndexBucketName, MempoolBucketName, OrphanBucketName} {
+            if tx.Bucket([]byte(name)) != nil {
+                err := tx.DeleteBucket([]byte(name))
+                if err != nil {
+                    return err
+                }
+            }
+        }
+
+        err := bucket.Put([]byte(LegacyHashKey), lastHash)
+        if err != nil {
+            return err
+        }
+        return bucket.Put([]byte(AmountUnitKey), []byte(AmountUnitSatoshi))
+    })
+    if err != nil {
+        return err
+    }
+    fmt.Printf("迁移 %d 个区块\n", count)
+    return nil
+}
+
+// 检查数据库的金额格式
+func checkAmountUnit(db *bolt.DB) {
+    db.View(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket([]byte(BucketName))
+        if bucket != nil && needMigrateAmounts(bucket) {
+            log.Fatal("数据库使用旧版本的金额格式, 请先执行 -migrate-amounts")
+        }
+        return nil
+    })
+}
@@ -0,0 +1,561 @@
+package block
+
+import (
+    "bytes"
+    "encoding/gob"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// 网络协议
+const protocol = "tcp"
+// 协议版本
+const nodeVersion = 1
+// 命令长度
+const commandLength = 12
+// 单条消息的最大长度，超过时丢弃，避免对方发送过大的消息耗尽内存
+const maxMessageSize = 32 * 1024 * 1024
+// 读取一条消息的超时时间
+const readTimeout = 30 * time.Second
+
+// 已知节点，多个节点使用逗号分隔，第一个节点作为种子节点
+const KnownNodesEnv = "KNOWN_NODES"
+const defaultKnownNode = "localhost:3000"
+
+// 节点角色
+const (
+    RoleFull   = "full"   // 全节点，保存完整的区块链并转发区块和交易
+    RoleMiner  = "miner"  // 矿工节点，全节点基础上将收到的交易打包挖矿
+    RoleWallet = "wallet" // 钱包节点，只同步区块和发送自己的交易，不转发其他节点的数据
+)
+
+// 消息类型
+const (
+    cmdVersion   = "version"
+    cmdAddr      = "addr"
+    cmdGetBlocks = "getblocks"
+    cmdInv       = "inv"
+    cmdGetData   = "getdata"
+    cmdBlock     = "block"
+    cmdTx        = "tx"
+)
+
+// 数据类型
+const (
+    invBlock = "block"
+    invTx    = "tx"
+)
+
+// 握手消息
+type versionMsg struct {
+    Version    int    // 协议版本
+    BestHeight int    // 区块链高度
+    AddrFrom   string // 发送方地址
+    Role       string // 发送方角色
+}
+
+// 节点地址消息
+type addrMsg struct {
+    AddrList []string
+}
+
+// 请求区块消息
+type getBlocksMsg struct {
+    AddrFrom string
+    LastHash []byte // 发送方最后一个区块 hash，只需要之后的区块
+}
+
+// 数据清单消息
+type invMsg struct {
+    AddrFrom string
+    Type     string
+    Items    [][]byte
+}
+
+// 请求数据消息
+type getDataMsg struct {
+    AddrFrom string
+    Type     string
+    Id       []byte
+}
+
+// 区块消息
+type blockMsg struct {
+    AddrFrom string
+    Block    []byte
+}
+
+// 交易消息
+type txMsg struct {
+    AddrFrom    string
+    Transaction []byte
+}
+
+// 网络节点
+type Node struct {
+    address         string                  // 当前节点地址
+    role            string                  // 节点角色
+    miner           string                  // 矿工地址
+    blockChain      *BlockChain
+    knownNodes      []string                // 已知节点
+    blocksInTransit [][]byte                // 等待下载的区块
+    mempool         *Mempool                // 交易池
+    orphans         *OrphanPool             // 孤块池
+    lock            sync.Mutex
+    chainLock       sync.Mutex              // 保证同一时间只有一个区块写入区块链
+}
+
+// 创建节点
+func NewNode(role string, miner string, blockChain *BlockChain) *Node {
+    return &Node{
+        address:    fmt.Sprintf("localhost:%s", GetNodeId()),
+        role:       role,
+        miner:      miner,
+        blockChain: blockChain,
+        knownNodes: getKnownNodes(),
+        mempool:    NewMempool(blockChain, true),
+        orphans:    NewOrphanPool(blockChain, true),
+    }
+}
+
+// 获取已知节点
+func getKnownNodes() []string {
+    knownNodes := os.Getenv(KnownNodesEnv)
+    if knownNodes == "" {
+        return []string{defaultKnownNode}
+    }
+    var nodes []string
+    for _, node := range strings.Split(knownNodes, ",") {
+        node = strings.TrimSpace(node)
+        if node != "" {
+            nodes = append(nodes, node)
+        }
+    }
+    return nodes
+}
+
+// 判断是否为有效的节点角色
+func IsValidRole(role string) bool {
+    return role == RoleFull || role == RoleMiner || role == RoleWallet
+}
+
+// 启动节点
+func (node *Node) Start() {
+    listener, err := net.Listen(protocol, node.address)
+    if err != nil {
+        log.Panic(err)
+    }
+    defer listener.Close()
+
+    fmt.Printf("节点 %s 启动, 角色: %s\n", node.address, node.role)
+
+    // 向种子节点发送版本信息
+    if len(node.knownNodes) > 0 && node.knownNodes[0] != node.address {
+        node.sendVersion(node.knownNodes[0])
+    }
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            log.Panic(err)
+        }
+        go node.handleConnection(conn)
+    }
+}
+
+// 将命令转换成字节
+func commandToBytes(command string) []byte {
+    var bytes [commandLength]byte
+    copy(bytes[:], command)
+    return bytes[:]
+}
+
+// 将字节转换成命令
+func bytesToCommand(bytes []byte) string {
+    var command []byte
+    for _, b := range bytes {
+        if b != 0x0 {
+            command = append(command, b)
+        }
+    }
+    return string(command)
+}
+
+// gob 序列化消息
+func gobEncode(data interface{}) []byte {
+    var buffer bytes.Buffer
+    encoder := gob.NewEncoder(&buffer)
+    err := encoder.Encode(data)
+    if err != nil {
+        log.Panic(err)
+    }
+    return buffer.Bytes()
+}
+
+// gob 反序列化消息
+// 消息来自其他节点，解析失败时返回错误，不能让节点退出
+func gobDecode(data []byte, v interface{}) error {
+    decoder := gob.NewDecoder(bytes.NewReader(data))
+    return decoder.Decode(v)
+}
+
+// 发送数据
+func (node *Node) sendData(addr string, data []byte) {
+    conn, err := net.Dial(protocol, addr)
+    if err != nil {
+        fmt.Printf("节点 %s 不可用\n", addr)
+        node.removeKnownNode(addr)
+        return
+    }
+    defer conn.Close()
+
+    _, err = io.Copy(conn, bytes.NewReader(data))
+    if err != nil {
+        fmt.Printf("向节点 %s 发送数据失败, err: %v\n", addr, err)
+    }
+}
+
+// 发送消息
+func (node *Node) sendMessage(addr string, command string, payload interface{}) {
+    data := append(commandToBytes(command), gobEncode(payload)...)
+    node.sendData(addr, data)
+}
+
+func (node *Node) sendVersion(addr string) {
+    node.sendMessage(addr, cmdVersion, versionMsg{nodeVersion, node.blockChain.Height(), node.address, node.role})
+}
+
+func (node *Node) sendAddr(addr string) {
+    node.sendMessage(addr, cmdAddr, addrMsg{append(node.getKnownNodes(), node.address)})
+}
+
+func (node *Node) sendGetBlocks(addr string) {
+    node.sendMessage(addr, cmdGetBlocks, getBlocksMsg{node.address, node.blockChain.LastBlockHash()})
+}
+
+func (node *Node) sendInv(addr, kind string, items [][]byte) {
+    node.sendMessage(addr, cmdInv, invMsg{node.address, kind, items})
+}
+
+func (node *Node) sendGetData(addr, kind string, id []byte) {
+    node.sendMessage(addr, cmdGetData, getDataMsg{node.address, kind, id})
+}
+
+func (node *Node) sendBlock(addr string, block *Block) {
+    node.sendMessage(addr, cmdBlock, blockMsg{node.address, block.ToBytes()})
+}
+
+func (node *Node) sendTx(addr string, tx *Transaction) {
+    node.sendMessage(addr, cmdTx, txMsg{node.address, tx.ToBytes()})
+}
+
+// 向已知节点发送交易
+// 用于不启动节点的客户端将交易发送到网络中
+func SendTransaction(tx *Transaction) {
+    node := &Node{address: fmt.Sprintf("localhost:%s", GetNodeId()), knownNodes: getKnownNodes()}
+    if len(node.knownNodes) == 0 {
+        fmt.Println("没有可用的节点!")
+        return
+    }
+    node.sendTx(node.knownNodes[0], tx)
+}
+
+// 处理连接
+func (node *Node) handleConnection(conn net.Conn) {
+    defer conn.Close()
+    err := conn.SetReadDeadline(time.Now().Add(readTimeout))
+    if err != nil {
+        fmt.Printf("设置读取超时失败, err: %v\n", err)
+        return
+    }
+    // 多读取一个字节，用于判断消息是否超过最大长度
+    request, err := ioutil.ReadAll(io.LimitReader(conn, maxMessageSize+1))
+    if err != nil {
+        fmt.Printf("读取数据失败, err: %v\n", err)
+        return
+    }
+    if len(request) > maxMessageSize {
+        fmt.Printf("消息长度超过上限 %d 字节\n", maxMessageSize)
+        return
+    }
+    if len(request) < commandLength {
+        fmt.Println("无效的消息")
+        return
+    }
+    command := bytesToCommand(request[:commandLength])
+    payload := request[commandLength:]
+    fmt.Printf("收到 %s 命令\n", command)
+
+    switch command {
+        case cmdVersion:
+            node.handleVersion(payload)
+        case cmdAddr:
+            node.handleAddr(payload)
+        case cmdGetBlocks:
+            node.handleGetBlocks(payload)
+        case cmdInv:
+            node.handleInv(payload)
+        case cmdGetData:
+            node.handleGetData(payload)
+        case cmdBlock:
+            node.handleBlock(payload)
+        case cmdTx:
+            node.handleTx(payload)
+        default:
+            fmt.Printf("未知命令 %s\n", command)
+    }
+}
+
+func (node *Node) handleVersion(payload []byte) {
+    var msg versionMsg
+    if err := gobDecode(payload, &msg); err != nil {
+        fmt.Printf("解析 version 消息失败, err: %v\n", err)
+        return
+    }
+
+    myHeight := node.blockChain.Height()
+    if myHeight < msg.BestHeight {
+        // 对方区块更多，请求区块
+        node.sendGetBlocks(msg.AddrFrom)
+    } else if myHeight > msg.BestHeight {
+        // 自己的区块更多，告诉对方
+        node.sendVersion(msg.AddrFrom)
+    }
+
+    if node.addKnownNode(msg.AddrFrom) {
+        node.sendAddr(msg.AddrFrom)
+    }
+}
+
+func (node *Node) handleAddr(payload []byte) {
+    var msg addrMsg
+    if err := gobDecode(payload, &msg); err != nil {
+        fmt.Printf("解析 addr 消息失败, err: %v\n", err)
+        return
+    }
+    for _, addr := range msg.AddrList {
+        if addr != node.address {
+            node.addKnownNode(addr)
+        }
+    }
+    fmt.Printf("已知节点: %d 个\n", len(node.getKnownNodes()))
+}
+
+func (node *Node) handleGetBlocks(payload []byte) {
+    var msg getBlocksMsg
+    if err := gobDecode(payload, &msg); err != nil {
+        fmt.Printf("解析 getblocks 消息失败, err: %v\n", err)
+        return
+    }
+    // 钱包节点不向其他节点提供区块
+    if node.role == RoleWallet {
+        return
+    }
+    hashes := node.blockChain.GetBlockHashesAfter(msg.LastHash)
+    if len(hashes) > 0 {
+        node.sendInv(msg.AddrFrom, invBlock, hashes)
+    }
+}
+
+func (node *Node) handleInv(payload []byte) {
+    var msg invMsg
+    if err := gobDecode(payload, &msg); err != nil {
+        fmt.Printf("解析 inv 消息失败, err: %v\n", err)
+        return
+    }
+    fmt.Printf("收到 %d 个 %s\n", len(msg.Items), msg.Type)
+
+    switch msg.Type {
+        case invBlock:
+            // 过滤已经存在的区块
+            var hashes [][]byte
+            for _, hash := range msg.Items {
+                if !node.blockChain.HasBlock(hash) && !node.orphans.Has(hash) {
+                    hashes = append(hashes, hash)
+                }
+            }
+            if len(hashes) == 0 {
+                return
+            }
+            node.lock.Lock()
+            node.blocksInTransit = hashes[1:]
+            node.lock.Unlock()
+            node.sendGetData(msg.AddrFrom, invBlock, hashes[0])
+        case invTx:
+            for _, txId := range msg.Items {
+                if !node.mempool.Has(txId) {
+                    node.sendGetData(msg.AddrFrom, invTx, txId)
+                }
+            }
+    }
+}
+
+func (node *Node) handleGetData(payload []byte) {
+    var msg getDataMsg
+    if err := gobDecode(payload, &msg); err != nil {
+        fmt.Printf("解析 getdata 消息失败, err: %v\n", err)
+        return
+    }
+
+    switch msg.Type {
+        case invBlock:
+            block := node.blockChain.GetBlockByHash(msg.Id)
+            if block == nil {
+                fmt.Printf("未找到区块 %x\n", msg.Id)
+                return
+            }
+            node.sendBlock(msg.AddrFrom, block)
+        case invTx:
+            tx := node.mempool.Get(msg.Id)
+            if tx == nil {
+                fmt.Printf("未找到交易 %x\n", msg.Id)
+                return
+            }
+            node.sendTx(msg.AddrFrom, tx)
+    }
+}
+
+func (node *Node) handleBlock(payload []byte) {
+    var msg blockMsg
+    if err := gobDecode(payload, &msg); err != nil {
+        fmt.Printf("解析 block 消息失败, err: %v\n", err)
+        return
+    }
+    block := &Block{}
+    if err := gobDecode(msg.Block, block); err != nil {
+        fmt.Printf("解析区块失败, err: %v\n", err)
+        return
+    }
+
+    node.chainLock.Lock()
+    saved, connected, err := node.orphans.ProcessBlock(block)
+    node.chainLock.Unlock()
+    if err != nil {
+        fmt.Printf("保存区块失败: %v\n", err)
+    } else if len(saved) == 0 {
+        // 孤块，向对方请求缺失的区块
+        node.sendGetBlocks(msg.AddrFrom)
+    }
+    for _, savedBlock := range saved {
+        fmt.Printf("保存区块 %x\n", savedBlock.Hash)
+        // 通知其他节点
+        node.broadcastInv(invBlock, savedBlock.Hash, msg.AddrFrom)
+    }
+    // 连接到主链的区块中的交易已经上链，从交易池中删除这些交易和与它们冲突的交易
+    // 链重组时包括新分支上之前保存的区块
+    for _, connectedBlock := range connected {
+        node.mempool.RemoveBlockTransactions(connectedBlock)
+    }
+    if len(connected) > 0 {
+        // 链重组时回滚的区块中的交易会放回交易池
+        node.mempool.Reload()
+    }
+
+    // 继续下载剩余的区块
+    node.lock.Lock()
+    var next []byte
+    if len(node.blocksInTransit) > 0 {
+        next = node.blocksInTransit[0]
+        node.blocksInTransit = node.blocksInTransit[1:]
+    }
+    node.lock.Unlock()
+    if next != nil {
+        node.sendGetData(msg.AddrFrom, invBlock, next)
+    }
+}
+
+func (node *Node) handleTx(payload []byte) {
+    var msg txMsg
+    if err := gobDecode(payload, &msg); err != nil {
+        fmt.Printf("解析 tx 消息失败, err: %v\n", err)
+        return
+    }
+    tx := &Transaction{}
+    if err := gobDecode(msg.Transaction, tx); err != nil {
+        fmt.Printf("解析交易失败, err: %v\n", err)
+        return
+    }
+
+    // 交易池负责校验签名和双花
+    err := node.mempool.Add(tx)
+    if err != nil {
+        fmt.Printf("发现无效的交易 %x: %v\n", tx.TxId, err)
+        return
+    }
+    fmt.Printf("收到交易 %x\n", tx.TxId)
+
+    // 转发交易
+    node.broadcastInv(invTx, tx.TxId, msg.AddrFrom)
+
+    if node.role == RoleMiner {
+        node.mine()
+    }
+}
+
+// 矿工节点将交易池中的交易打包挖矿
+func (node *Node) mine() {
+    node.chainLock.Lock()
+    block, err := node.blockChain.MineBlock(node.miner, node.mempool)
+    node.chainLock.Unlock()
+    if err != nil {
+        fmt.Printf("挖矿失败: %v\n", err)
+        return
+    }
+    fmt.Printf("挖出新区块 %x\n", block.Hash)
+
+    node.broadcastInv(invBlock, block.Hash, "")
+}
+
+// 向其他节点发送数据清单
+// 钱包节点不转发数据
+func (node *Node) broadcastInv(kind string, id []byte, except string) {
+    if node.role == RoleWallet {
+        return
+    }
+    for _, addr := range node.getKnownNodes() {
+        if addr != node.address && addr != except {
+            node.sendInv(addr, kind, [][]byte{id})
+        }
+    }
+}
+
+// 添加已知节点，返回是否为新节点
+func (node *Node) addKnownNode(addr string) bool {
+    node.lock.Lock()
+    defer node.lock.Unlock()
+    for _, known := range node.knownNodes {
+        if known == addr {
+            return false
+        }
+    }
+    node.knownNodes = append(node.knownNodes, addr)
+    return true
+}
+
+// 删除不可用的节点
+func (node *Node) removeKnownNode(addr string) {
+    node.lock.Lock()
+    defer node.lock.Unlock()
+    var nodes []string
+    for _, known := range node.knownNodes {
+        if known != addr {
+            nodes = append(nodes, known)
+        }
+    }
+    node.knownNodes = nodes
+}
+
+func (node *Node) getKnownNodes() []string {
+    node.lock.Lock()
+    defer node.lock.Unlock()
+    nodes := make([]string, len(node.knownNodes))
+    copy(nodes, node.knownNodes)
+    return nodes
+}
@@ -0,0 +1,300 @@
+package block
+
+import (
+    "bytes"
+    "encoding/gob"
+    "fmt"
+    "github.com/boltdb/bolt"
+    "log"
+    "math/big"
+    "sort"
+    "sync"
+    "time"
+)
+
+// 孤块池使用的 Bucket
+// key 为区块 hash，value 为孤块
+const OrphanBucketName = "orphan_bucket"
+
+// 孤块池最多保存的区块数，超过时删除最早收到的区块
+const MaxOrphanBlocks = 100
+
+// 孤块最长保存时间（秒），超过时删除
+const MaxOrphanAge = 60 * 60
+
+// 孤块，前一个区块还没有收到的区块
+type OrphanBlock struct {
+    Block    *Block // 区块
+    Received int64  // 收到区块的时间
+}
+
+// 孤块序列化
+func (orphan *OrphanBlock) ToBytes() []byte {
+    var buffer bytes.Buffer
+    encoder := gob.NewEncoder(&buffer)
+    err := encoder.Encode(orphan)
+    if err != nil {
+        log.Panic(err)
+    }
+    return buffer.Bytes()
+}
+
+// 孤块反序列化
+func (orphan *OrphanBlock) ToOrphanBlock(data []byte) {
+    decoder := gob.NewDecoder(bytes.NewReader(data))
+    err := decoder.Decode(orphan)
+    if err != nil {
+        log.Panic(err)
+    }
+}
+
+// 孤块池
+// 区块不按顺序到达时，先保存前一个区块不存在的区块，前一个区块到达后自动连接
+type OrphanPool struct {
+    blockChain *BlockChain
+    persist    bool                      // 是否保存到数据库
+    orphans    map[string]*OrphanBlock   // 区块 hash => 孤块
+    children   map[string][]*OrphanBlock // 前一个区块 hash => 孤块
+    lock       sync.Mutex
+}
+
+// 创建孤块池
+// persist 为 true 时，孤块池保存到数据库中，并加载之前保存的孤块
+func NewOrphanPool(blockChain *BlockChain, persist bool) *OrphanPool {
+    pool := &OrphanPool{
+        blockChain: blockChain,
+        persist:    persist,
+        orphans:    make(map[string]*OrphanBlock),
+        children:   make(map[string][]*OrphanBlock),
+    }
+    if !persist {
+        return pool
+    }
+
+    var orphans []*OrphanBlock
+    err := blockChain.boltDB.Update(func(tx *bolt.Tx) error {
+        bucket, err := tx.CreateBucketIfNotExists([]byte(OrphanBucketName))
+        if err != nil {
+            return err
+        }
+        return bucket.ForEach(func(key, value []byte) error {
+            orphan := &OrphanBlock{}
+            orphan.ToOrphanBlock(value)
+            orphans = append(orphans, orphan)
+            return nil
+        })
+    })
+    if err != nil {
+        log.Panic(err)
+    }
+    for _, orphan := range orphans {
+        pool.add(orphan)
+    }
+    pool.expire()
+    return pool
+}
+
+// 读取数据库中保存的孤块，按照收到的时间排序
+// 只使用读事务，不删除过期的孤块，可以用于只读打开的区块链
+func LoadOrphans(blockChain *BlockChain) []*OrphanBlock {
+    pool := NewOrphanPool(blockChain, false)
+    err := blockChain.view(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket([]byte(OrphanBucketName))
+        if bucket == nil {
+            return nil
+        }
+        return bucket.ForEach(func(key, value []byte) error {
+            orphan := &OrphanBlock{}
+            orphan.ToOrphanBlock(value)
+            pool.add(orphan)
+            return nil
+        })
+    })
+    if err != nil {
+        log.Panic(err)
+    }
+    return pool.sortedOrphans()
+}
+
+// 判断区块的前一个区块是否缺失
+func (pool *OrphanPool) isOrphan(block *Block) bool {
+    // 没有区块时只接受创世块
+    if pool.blockChain.LastBlockHash() == nil {
+        return !bytes.Equal(block.PrevHash, []byte{0x0000000000000000})
+    }
+    return !pool.blockChain.HasBlock(block.PrevHash)
+}
+
+// 检查孤块的工作量证明
+// 孤块的前一个区块未知，无法计算应使用的难度，只检查 hash 满足区块自己声明的难度，避免孤块池被没有工作量的区块占满
+func checkOrphanBlock(block *Block) error {
+    if !bytes.Equal(block.CalculateHash(), block.Hash) {
+        return fmt.Errorf("区块 %x 的 hash 与区块头不一致", block.Hash)
+    }
+    target := DifficultyToTarget(block.Difficulty)
+    if target.Sign() <= 0 || target.Cmp(powLimit) > 0 {
+        return fmt.Errorf("区块 %x 的难度值 %x 无效", block.Hash, block.Difficulty)
+    }
+    if new(big.Int).SetBytes(block.Hash).Cmp(target) >= 0 {
+        return fmt.Errorf("区块 %x 工作量证明无效", block.Hash)
+    }
+    return nil
+}
+
+// 将孤块加入内存
+func (pool *OrphanPool) add(orphan *OrphanBlock) {
+    key := string(orphan.Block.Hash)
+    if _, ok := pool.orphans[key]; ok {
+        return
+    }
+    pool.orphans[key] = orphan
+    prevKey := string(orphan.Block.PrevHash)
+    pool.children[prevKey] = append(pool.children[prevKey], orphan)
+}
+
+// 将孤块从内存和数据库中删除
+func (pool *OrphanPool) remove(hash []byte) {
+    key := string(hash)
+    orphan, ok := pool.orphans[key]
+    if !ok {
+        return
+    }
+    delete(pool.orphans, key)
+    prevKey := string(orphan.Block.PrevHash)
+    children := pool.children[prevKey]
+    for i, child := range children {
+        if child == orphan {
+            children = append(children[:i], children[i+1:]...)
+            break
+        }
+    }
+    if len(children) == 0 {
+        delete(pool.children, prevKey)
+    } else {
+        pool.children[prevKey] = children
+    }
+    pool.deleteFromDB(hash)
+}
+
+// 删除超过保存时间的孤块，数量超过上限时删除最早收到的孤块
+func (pool *OrphanPool) expire() {
+    now := time.Now().Unix()
+    orphans := pool.sortedOrphans()
+    for i, orphan := range orphans {
+        if now-orphan.Received > MaxOrphanAge || len(orphans)-i > MaxOrphanBlocks {
+            fmt.Printf("删除孤块 %x\n", orphan.Block.Hash)
+            pool.remove(orphan.Block.Hash)
+        }
+    }
+}
+
+// 按照收到的时间排序
+func (pool *OrphanPool) sortedOrphans() []*OrphanBlock {
+    var orphans []*OrphanBlock
+    for _, orphan := range pool.orphans {
+        orphans = append(orphans, orphan)
+    }
+    sort.Slice(orphans, func(i, j int) bool {
+        return orphans[i].Received < orphans[j].Received
+    })
+    return orphans
+}
+
+func (pool *OrphanPool) saveToDB(orphan *OrphanBlock) {
+    if !pool.persist {
+        return
+    }
+    err := pool.blockChain.boltDB.Update(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket([]byte(OrphanBucketName))
+        return bucket.Put(orphan.Block.Hash, orphan.ToBytes())
+    })
+    if err != nil {
+        log.Panic(err)
+    }
+}
+
+func (pool *OrphanPool) deleteFromDB(hash []byte) {
+    if !pool.persist {
+        return
+    }
+    err := pool.blockChain.boltDB.Update(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket([]byte(OrphanBucketName))
+        return bucket.Delete(hash)
+    })
+    if err != nil {
+        log.Panic(err)
+    }
+}
+
+// 处理收到的区块
+// 前一个区块不存在时加入孤块池，否则保存区块，并依次连接以该区块为前一个区块的孤块
+// 返回保存成功的区块，区块加入孤块池时返回空
+// 同时返回连接到主链上的区块，链重组时包括新分支上之前保存的区块
+func (pool *OrphanPool) ProcessBlock(block *Block) ([]*Block, []*Block, error) {
+    pool.lock.Lock()
+    defer pool.lock.Unlock()
+
+    if _, ok := pool.orphans[string(block.Hash)]; ok {
+        return nil, nil, fmt.Errorf("区块 %x 已在孤块池中", block.Hash)
+    }
+    if pool.isOrphan(block) {
+        if pool.blockChain.HasBlock(block.Hash) {
+            return nil, nil, fmt.Errorf("区块 %x 已存在", block.Hash)
+        }
+        if err := checkOrphanBlock(block); err != nil {
+            return nil, nil, err
+        }
+        orphan := &OrphanBlock{block, time.Now().Unix()}
+        pool.add(orphan)
+        pool.saveToDB(orphan)
+        pool.expire()
+        fmt.Printf("区块 %x 的前一个区块 %x 不存在, 加入孤块池\n", block.Hash, block.PrevHash)
+        return nil, nil, nil
+    }
+
+    connected, err := pool.blockChain.SaveBlock(block)
+    if err != nil {
+        return nil, nil, err
+    }
+    saved := []*Block{block}
+
+    // 连接等待该区块的孤块
+    for i := 0; i < len(saved); i++ {
+        children := append([]*OrphanBlock{}, pool.children[string(saved[i].Hash)]...)
+        for _, orphan := range children {
+            pool.remove(orphan.Block.Hash)
+            blocks, err := pool.blockChain.SaveBlock(orphan.Block)
+            if err != nil {
+                fmt.Printf("连接孤块失败: %v\n", err)
+                continue
+            }
+            connected = append(connected, blocks...)
+            fmt.Printf("连接孤块 %x\n", orphan.Block.Hash)
+            saved = append(saved, orphan.Block)
+        }
+    }
+    return saved, connected, nil
+}
+
+// 判断区块是否在孤块池中
+func (pool *OrphanPool) Has(hash []byte) bool {
+    pool.lock.Lock()
+    defer pool.lock.Unlock()
+    _, ok := pool.orphans[string(hash)]
+    return ok
+}
+
+// 孤块池中的区块数
+func (pool *OrphanPool) Count() int {
+    pool.lock.Lock()
+    defer pool.lock.Unlock()
+    return len(pool.orphans)
+}
+
+// 获取孤块池中的所有孤块，按照收到的时间排序
+func (pool *OrphanPool) Orphans() []*OrphanBlock {
+    pool.lock.Lock()
+    defer pool.lock.Unlock()
+    pool.expire()
+    return pool.sortedOrphans()
+}
@@ -8,7 +8,7 @@ import (
     "math/big"
 )
 
-// 用来推导难度值
+// 用来推导创世块的难度值
 const Bits = 16
 
 // 工作量证明
@@ -19,7 +19,7 @@ type ProofOfWork struct {
 
 // 创建工作量证明函数
 func NewProofOfWork(block *Block) *ProofOfWork {
-    // 难度值，应该是推导出来的，这里先定死
+    // 难度值，最早是定死的
     // targetStr := "0001000000000000000000000000000000000000000000000000000000000000"
     // var targetBigInt big.Int
     // targetBigInt.SetString(targetStr, 16)
@@ -32,13 +32,10 @@ func NewProofOfWork(block *Block) *ProofOfWork {
     // 再将对应的二进制位右移 16 位
     //0 0001000000000000000000000000000000000000000000000000000000000000
 
-    targetBigInt := big.NewInt(1)
-    // targetBigInt.Lsh(targetBigInt, 256)
-    // targetBigInt.Rsh(targetBigInt, 16)
-    targetBigInt.Lsh(targetBigInt, 256-Bits)
+    // 现在难度值会动态调整，使用区块中保存的压缩格式的难度值推导目标值
     pow := ProofOfWork{
         block:  block,
-        target: targetBigInt,
+        target: DifficultyToTarget(block.Difficulty),
     }
     return &pow
 }
@@ -66,10 +63,14 @@ func (pow *ProofOfWork) Run() ([]byte, uint64) {
 }
 
 // 校验挖矿是否有效
-func (pow *ProofOfWork) IsValid() bool {
+// difficulty 为区块链规则要求该高度的区块使用的难度值
+func (pow *ProofOfWork) IsValid(difficulty uint64) bool {
+    if !SameDifficulty(pow.block.Difficulty, difficulty) {
+        return false
+    }
     var bigInt big.Int
     bigInt.SetBytes(pow.block.Hash)
-    return bigInt.Cmp(pow.target) == -1
+    return bigInt.Cmp(DifficultyToTarget(difficulty)) == -1
 }
 
 func toBytes(block *Block, nonce uint64) []byte {
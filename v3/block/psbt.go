@@ -0,0 +1,198 @@
+package block
+
+import (
+    "bytes"
+    "encoding/gob"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "strings"
+)
+
+// 部分签名交易文件（类似比特币的 PSBT）
+// 联网的只读钱包创建未签名的交易，文件中同时保存每个 input 引用的完整交易
+// 离线的钱包不需要区块链，重新计算引用的交易的 id 后，根据其中的 output 签名和计算手续费，之后由联网的节点提交
+// 只保存 output 时无法确认金额的真假，篡改后的文件可以虚报输入金额，使签名的交易支付大量手续费
+
+// 文件开头的标记
+const PSBTMagic = "psbt\xff"
+
+// 部分签名的交易
+type PartiallySignedTx struct {
+    Tx      *Transaction   // 交易，签名后解锁脚本不为空
+    PrevTxs []*Transaction // 每个 input 引用的交易，与 inputs 的顺序一致
+}
+
+// 创建部分签名的交易，input 引用的 output 必须在 UTXO 集合中，从交易索引中查找引用的交易
+func NewPartiallySignedTx(tx *Transaction, blockChain *BlockChain) (*PartiallySignedTx, error) {
+    psbt := &PartiallySignedTx{Tx: tx}
+    for _, input := range tx.TxInputs {
+        if _, ok := blockChain.GetUTXO(input.TxId, input.Index); !ok {
+            return nil, fmt.Errorf("output %s 不存在或已被花费", outPointKey(input.TxId, input.Index))
+        }
+        prevTx, _ := blockChain.GetTransaction(input.TxId)
+        if prevTx == nil {
+            return nil, fmt.Errorf("未找到 input 引用的交易 %x", input.TxId)
+        }
+        psbt.PrevTxs = append(psbt.PrevTxs, prevTx)
+    }
+    return psbt, nil
+}
+
+// 检查文件中 input 引用的交易
+// 重新计算的交易 id 必须等于 input 引用的交易 id，output 的索引不能越界，否则文件中的金额和锁定脚本不可信
+func (psbt *PartiallySignedTx) CheckPrevTxs() error {
+    for i, input := range psbt.Tx.TxInputs {
+        prevTx := psbt.PrevTxs[i]
+        if prevTx == nil || !bytes.Equal(prevTx.CalculateTxID(), input.TxId) {
+            return fmt.Errorf("input %d 引用的交易与交易 id %x 不一致", i, input.TxId)
+        }
+        if input.Index < 0 || input.Index >= len(prevTx.TxOutputs) {
+            return fmt.Errorf("input %d 引用的 output %s 不存在", i, outPointKey(input.TxId, input.Index))
+        }
+    }
+    return nil
+}
+
+// 获取第 i 个 input 引用的 output，调用前先使用 CheckPrevTxs 检查
+func (psbt *PartiallySignedTx) prevOutput(i int) *TxOutput {
+    return &psbt.PrevTxs[i].TxOutputs[psbt.Tx.TxInputs[i].Index]
+}
+
+// 序列化，标记加上 gob 编码
+func (psbt *PartiallySignedTx) ToBytes() []byte {
+    var buffer bytes.Buffer
+    buffer.WriteString(PSBTMagic)
+    encoder := gob.NewEncoder(&buffer)
+    err := encoder.Encode(psbt)
+    if err != nil {
+        log.Panic(err)
+    }
+    return buffer.Bytes()
+}
+
+// 反序列化
+func ToPartiallySignedTx(data []byte) (*PartiallySignedTx, error) {
+    if !bytes.HasPrefix(data, []byte(PSBTMagic)) {
+        return nil, fmt.Errorf("不是部分签名交易文件")
+    }
+    var psbt PartiallySignedTx
+    decoder := gob.NewDecoder(bytes.NewReader(data[len(PSBTMagic):]))
+    err := decoder.Decode(&psbt)
+    if err != nil {
+        return nil, fmt.Errorf("部分签名交易文件格式错误: %v", err)
+    }
+    if psbt.Tx == nil || len(psbt.PrevTxs) != len(psbt.Tx.TxInputs) {
+        return nil, fmt.Errorf("部分签名交易文件格式错误: 引用的交易数量与 input 数量不一致")
+    }
+    if !bytes.Equal(psbt.Tx.CalculateTxID(), psbt.Tx.TxId) {
+        return nil, fmt.Errorf("交易 id 与内容不一致")
+    }
+    return &psbt, nil
+}
+
+// 保存到文件
+func (psbt *PartiallySignedTx) Save(filename string) error {
+    return ioutil.WriteFile(filename, psbt.ToBytes(), 0600)
+}
+
+// 从文件加载
+func LoadPartiallySignedTx(filename string) (*PartiallySignedTx, error) {
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+    return ToPartiallySignedTx(data)
+}
+
+// 根据文件中引用的交易计算手续费，引用的交易校验失败时返回错误
+func (psbt *PartiallySignedTx) Fee() (int64, error) {
+    err := psbt.CheckPrevTxs()
+    if err != nil {
+        return 0, err
+    }
+    var inputValue int64
+    for i := range psbt.Tx.TxInputs {
+        inputValue, err = AddAmount(inputValue, psbt.prevOutput(i).Value)
+        if err != nil {
+            return 0, err
+        }
+    }
+    outputValue, err := psbt.Tx.OutputValue()
+    if err != nil {
+        return 0, err
+    }
+    if inputValue < outputValue {
+        return 0, fmt.Errorf("输出金额 %s 大于输入金额 %s", FormatAmount(outputValue), FormatAmount(inputValue))
+    }
+    return inputValue - outputValue, nil
+}
+
+// 检查文件中引用的交易，以及引用的 output 与 UTXO 集合一致，提交前调用
+func (psbt *PartiallySignedTx) Check(blockChain *BlockChain) error {
+    err := psbt.CheckPrevTxs()
+    if err != nil {
+        return err
+    }
+    for i, input := range psbt.Tx.TxInputs {
+        output, ok := blockChain.GetUTXO(input.TxId, input.Index)
+        if !ok {
+            return fmt.Errorf("output %s 不存在或已被花费", outPointKey(input.TxId, input.Index))
+        }
+        prevOutput := psbt.prevOutput(i)
+        if output.Value != prevOutput.Value || !bytes.Equal(output.LockScript(), prevOutput.LockScript()) {
+            return fmt.Errorf("input %d 引用的 output 与区块链不一致", i)
+        }
+    }
+    return nil
+}
+
+// 显示交易的付款人、收款人和手续费，签名前确认
+func (psbt *PartiallySignedTx) String() string {
+    var lines []string
+    lines = append(lines, fmt.Sprintf("交易 %x:", psbt.Tx.TxId))
+    if err := psbt.CheckPrevTxs(); err != nil {
+        lines = append(lines, fmt.Sprintf("    输入: %v", err))
+    } else {
+        for i := range psbt.Tx.TxInputs {
+            output := psbt.prevOutput(i)
+            lines = append(lines, fmt.Sprintf("    输入 %d: %s %s", i, output.Address(), FormatAmount(output.Value)))
+        }
+    }
+    for i, output := range psbt.Tx.TxOutputs {
+        lines = append(lines, fmt.Sprintf("    输出 %d: %s %s", i, output.Address(), FormatAmount(output.Value)))
+    }
+    if fee, err := psbt.Fee(); err != nil {
+        lines = append(lines, fmt.Sprintf("    手续费: %v", err))
+    } else {
+        lines = append(lines, fmt.Sprintf("    手续费: %s", FormatAmount(fee)))
+    }
+    lines = append(lines, fmt.Sprintf("    还需要 %d 个签名", psbt.Tx.MissingSignatures()))
+    return strings.Join(lines, "\n")
+}
+
+// 使用钱包中的私钥签名，返回添加的签名数
+// P2PKH input 使用文件中引用的交易的 output 签名，多重签名 input 添加钱包中的私钥的签名
+// 引用的交易校验失败时不签名
+func (wallets *Wallets) SignPartiallySignedTx(psbt *PartiallySignedTx) (int, error) {
+    if wallets.IsLocked() {
+        return 0, fmt.Errorf("钱包已加密, 请先解锁")
+    }
+    err := psbt.CheckPrevTxs()
+    if err != nil {
+        return 0, err
+    }
+    count := 0
+    for _, walletKeyPair := range wallets.WalletMap {
+        for i := range psbt.Tx.TxInputs {
+            if psbt.Tx.signInput(i, walletKeyPair.PrivateKey, psbt.prevOutput(i)) {
+                count++
+            }
+        }
+    }
+    added, err := wallets.SignMultiSig(psbt.Tx)
+    if err != nil {
+        return 0, err
+    }
+    return count + added, nil
+}
@@ -0,0 +1,75 @@
+package block
+
+import (
+    "testing"
+)
+
+func TestSignPartiallySignedTx(t *testing.T) {
+    key := newTestKey(t)
+    walletKeyPair := &WalletKeyPair{key, key.PubKey().SerializeCompressed()}
+    wallets := &Wallets{WalletMap: map[string]*WalletKeyPair{walletKeyPair.GetAddress(): walletKeyPair}}
+    p2pkh := PayToPublicKeyHashScript(HashPublicKey(walletKeyPair.PublicKey))
+
+    // 引用的交易和花费它的交易，手续费为 1000
+    newTestPSBT := func() *PartiallySignedTx {
+        prevTx := &Transaction{
+            TxInputs:  []TxInput{{TxId: []byte("prev"), Index: 0, Sequence: MaxSequence}},
+            TxOutputs: []TxOutput{{Value: 5000, ScriptPubKey: p2pkh}},
+            Version:   TxVersion,
+        }
+        prevTx.SetTxID()
+        tx := &Transaction{
+            TxInputs:  []TxInput{{TxId: prevTx.TxId, Index: 0, Sequence: MaxSequence}},
+            TxOutputs: []TxOutput{{Value: 4000, ScriptPubKey: p2pkh}},
+            Version:   TxVersion,
+        }
+        tx.SetTxID()
+        return &PartiallySignedTx{Tx: tx, PrevTxs: []*Transaction{prevTx}}
+    }
+
+    tests := []struct {
+        name    string
+        tamper  func(psbt *PartiallySignedTx)
+        fee     int64
+        wantErr bool
+    }{
+        {"有效", func(psbt *PartiallySignedTx) {}, 1000, false},
+        {"虚报输入金额", func(psbt *PartiallySignedTx) {
+            psbt.PrevTxs[0].TxOutputs[0].Value = 5000000
+        }, 0, true},
+        {"替换为其他交易", func(psbt *PartiallySignedTx) {
+            psbt.PrevTxs[0].TxOutputs[0].Value = 5000000
+            psbt.PrevTxs[0].SetTxID()
+        }, 0, true},
+        {"output 索引越界", func(psbt *PartiallySignedTx) {
+            psbt.Tx.TxInputs[0].Index = 1
+        }, 0, true},
+        {"缺少引用的交易", func(psbt *PartiallySignedTx) {
+            psbt.PrevTxs[0] = nil
+        }, 0, true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            psbt := newTestPSBT()
+            test.tamper(psbt)
+
+            fee, err := psbt.Fee()
+            if (err != nil) != test.wantErr || fee != test.fee {
+                t.Errorf("Fee() = %d, %v, 期望 %d, wantErr %v", fee, err, test.fee, test.wantErr)
+            }
+            count, err := wallets.SignPartiallySignedTx(psbt)
+            if (err != nil) != test.wantErr {
+                t.Fatalf("SignPartiallySignedTx() err = %v, wantErr %v", err, test.wantErr)
+            }
+            if test.wantErr {
+                if count != 0 || psbt.Tx.TxInputs[0].ScriptSig != nil {
+                    t.Errorf("引用的交易无效时不应签名")
+                }
+                return
+            }
+            if count != 1 || !psbt.Tx.Verify(map[string]*Transaction{string(psbt.Tx.TxInputs[0].TxId): psbt.PrevTxs[0]}) {
+                t.Errorf("签名后的交易校验失败, 签名数 %d", count)
+            }
+        })
+    }
+}
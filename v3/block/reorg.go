@@ -0,0 +1,227 @@
+package block
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/boltdb/bolt"
+    "math/big"
+    "sort"
+)
+
+// 分叉和链重组
+// 数据库保存所有收到的有效区块，区块的前一个区块可以是任意已知的区块
+// 主链为累计工作量最大的分支，最后一个区块 hash、区块高度索引、交易索引和 UTXO 集合只对应主链
+// 其他分支的累计工作量超过主链时，回滚主链上分叉点之后的区块，再依次连接新分支上的区块
+
+// 计算一个区块的工作量，即平均需要计算多少次 hash 才能找到满足目标值的区块
+// 工作量 = 2^256 / (目标值 + 1)
+func BlockWork(difficulty uint64) *big.Int {
+    target := DifficultyToTarget(difficulty)
+    if target.Sign() <= 0 {
+        return big.NewInt(0)
+    }
+    denominator := new(big.Int).Add(target, big.NewInt(1))
+    return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// 存入区块，根据前一个区块计算区块高度和累计工作量
+// 区块高度和累计工作量不参与区块头 hash 的计算
+func storeBlock(bucket *bolt.Bucket, block *Block) error {
+    block.Height = 0
+    block.ChainWork = BlockWork(block.Difficulty)
+    value := bucket.Get(block.PrevHash)
+    if value != nil {
+        prevBlock := Block{}
+        prevBlock.ToBlock(value)
+        block.Height = prevBlock.Height + 1
+        if prevBlock.ChainWork != nil {
+            block.ChainWork.Add(block.ChainWork, prevBlock.ChainWork)
+        }
+    }
+    return bucket.Put(block.Hash, block.ToBytes())
+}
+
+// 将主链的最后一个区块断开
+// 1.删除区块中交易产生的 output 和交易索引
+// 2.恢复 input 引用的 output
+// 3.删除区块高度索引，最后一个区块改为前一个区块
+func (blockChain *BlockChain) disconnectBlock(tx *bolt.Tx, block *Block) error {
+    bucket := tx.Bucket([]byte(BucketName))
+    UTXOBucket := tx.Bucket([]byte(UTXOBucketName))
+    txIndexBucket := tx.Bucket([]byte(TxIndexBucketName))
+
+    if !bytes.Equal(bucket.Get([]byte(LastHashKey)), block.Hash) {
+        return fmt.Errorf("区块 %x 不是最后一个区块", block.Hash)
+    }
+
+    // 倒序处理，同一个区块中后面的交易可能引用前面交易的 output
+    for i := len(block.Transactions) - 1; i >= 0; i-- {
+        transaction := block.Transactions[i]
+        err := UTXOBucket.Delete(transaction.TxId)
+        if err != nil {
+            return err
+        }
+
+        if !transaction.IsCoinBase() {
+            for _, input := range transaction.TxInputs {
+                prevTx, prevBlock := getTransactionInTx(tx, input.TxId)
+                if prevTx == nil || input.Index < 0 || input.Index >= len(prevTx.TxOutputs) {
+                    return fmt.Errorf("未找到交易 %x 引用的 output %s", transaction.TxId, outPointKey(input.TxId, input.Index))
+                }
+                err = restoreUTXO(UTXOBucket, UTXOInfo{input.TxId, input.Index, prevTx.TxOutputs[input.Index], prevBlock.Height, prevTx.IsCoinBase()})
+                if err != nil {
+                    return err
+                }
+            }
+        }
+
+        err = txIndexBucket.Delete(transaction.TxId)
+        if err != nil {
+            return err
+        }
+    }
+
+    err := tx.Bucket([]byte(HeightBucketName)).Delete(heightToBytes(block.Height))
+    if err != nil {
+        return err
+    }
+    err = bucket.Put([]byte(LastHashKey), block.PrevHash)
+    if err != nil {
+        return err
+    }
+    blockChain.lastBlockHash = block.PrevHash
+    return nil
+}
+
+// 将 output 放回 UTXO 集合，按照 output 索引排序
+func restoreUTXO(bucket *bolt.Bucket, info UTXOInfo) error {
+    var UTXOInfos []UTXOInfo
+    if value := bucket.Get(info.TxId); value != nil {
+        UTXOInfos = bytesToUTXOs(value)
+    }
+    for _, UTXOInfo := range UTXOInfos {
+        if UTXOInfo.Index == info.Index {
+            return nil
+        }
+    }
+    UTXOInfos = append(UTXOInfos, info)
+    sort.Slice(UTXOInfos, func(i, j int) bool {
+        return UTXOInfos[i].Index < UTXOInfos[j].Index
+    })
+    return bucket.Put(info.TxId, utxosToBytes(UTXOInfos))
+}
+
+// 找到两个区块所在分支的分叉点
+// 返回分叉点之后两个分支上的区块，按照从分叉点到最后一个区块的顺序
+func (blockChain *BlockChain) findFork(oldTip, newTip *Block) ([]*Block, []*Block, error) {
+    var detach, attach []*Block
+    for !bytes.Equal(oldTip.Hash, newTip.Hash) {
+        // 高度较大的一方先向前移动，高度相同时两方同时移动
+        oldHeight, newHeight := oldTip.Height, newTip.Height
+        if oldHeight >= newHeight {
+            detach = append([]*Block{oldTip}, detach...)
+            oldTip = blockChain.GetBlockByHash(oldTip.PrevHash)
+        }
+        if newHeight >= oldHeight {
+            attach = append([]*Block{newTip}, attach...)
+            newTip = blockChain.GetBlockByHash(newTip.PrevHash)
+        }
+        if oldTip == nil || newTip == nil {
+            return nil, nil, fmt.Errorf("两个分支没有共同的区块")
+        }
+    }
+    return detach, attach, nil
+}
+
+// 链重组，将主链切换到 newTip 所在的分支
+// 回滚和连接区块在同一个事务中完成，新分支上的区块连接时才校验交易，校验失败时事务回滚，保持原来的主链并删除无效的区块
+// 回滚的区块中没有进入新分支的交易放回交易池，返回新分支上连接的区块
+func (blockChain *BlockChain) reorganize(newTip *Block) ([]*Block, error) {
+    oldTip := blockChain.GetBlockByHash(blockChain.lastBlockHash)
+    detach, attach, err := blockChain.findFork(oldTip, newTip)
+    if err != nil {
+        return nil, err
+    }
+
+    var invalidBlocks []*Block
+    lastBlockHash := blockChain.lastBlockHash
+    err = blockChain.boltDB.Update(func(tx *bolt.Tx) error {
+        // 使用绑定到写事务的区块链校验区块，读取到前面回滚和连接的结果
+        chain := &BlockChain{boltDB: blockChain.boltDB, lastBlockHash: blockChain.lastBlockHash, params: blockChain.params, tx: tx}
+
+        // 从最后一个区块开始回滚到分叉点
+        for i := len(detach) - 1; i >= 0; i-- {
+            err := chain.disconnectBlock(tx, detach[i])
+            if err != nil {
+                return err
+            }
+        }
+
+        // 依次连接新分支上的区块
+        for i, block := range attach {
+            err := chain.checkBlockTransactions(block)
+            if err != nil {
+                invalidBlocks = attach[i:]
+                return fmt.Errorf("区块 %x 无效: %v", block.Hash, err)
+            }
+            err = chain.connectBlock(tx, block)
+            if err != nil {
+                return err
+            }
+        }
+
+        err := restoreMempoolTxs(tx, detach)
+        if err != nil {
+            return err
+        }
+        lastBlockHash = chain.lastBlockHash
+        return nil
+    })
+    if err != nil {
+        if len(invalidBlocks) > 0 {
+            // 新分支无效，删除无效的区块和之后的区块
+            fmt.Printf("区块 %x 无效, 保持原来的主链\n", invalidBlocks[0].Hash)
+            deleteErr := blockChain.boltDB.Update(func(tx *bolt.Tx) error {
+                for _, invalidBlock := range invalidBlocks {
+                    err := tx.Bucket([]byte(BucketName)).Delete(invalidBlock.Hash)
+                    if err != nil {
+                        return err
+                    }
+                }
+                return nil
+            })
+            if deleteErr != nil {
+                return nil, deleteErr
+            }
+        }
+        return nil, err
+    }
+    blockChain.lastBlockHash = lastBlockHash
+
+    fmt.Printf("链重组: 回滚 %d 个区块, 连接 %d 个区块\n", len(detach), len(attach))
+    return attach, nil
+}
+
+// 将回滚的区块中的交易放回交易池，跳过挖矿交易和已经在新主链上的交易
+// 交易池加载时会重新校验这些交易，删除与新主链冲突的交易
+func restoreMempoolTxs(tx *bolt.Tx, blocks []*Block) error {
+    bucket, err := tx.CreateBucketIfNotExists([]byte(MempoolBucketName))
+    if err != nil {
+        return err
+    }
+    for _, block := range blocks {
+        for _, transaction := range block.Transactions {
+            if transaction.IsCoinBase() {
+                continue
+            }
+            if onChain, _ := getTransactionInTx(tx, transaction.TxId); onChain != nil {
+                continue
+            }
+            err := bucket.Put(transaction.TxId, transaction.ToBytes())
+            if err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
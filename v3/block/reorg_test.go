@@ -0,0 +1,95 @@
+package block
+
+import (
+    "io/ioutil"
+    "math/big"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// 在 prevHash 之后挖一个高度为 height 的区块，只有挖矿交易，fees 不为 0 时挖矿奖励超过允许的金额
+// 不使用 ProofOfWork.Run，避免输出每次计算的 hash
+func mineTestBlock(prevHash []byte, height int, timestamp uint64, miner string, fees int64) *Block {
+    coinBase := NewCoinBaseTx(miner, "test", BlockSubsidy(DefaultChainParams(), height) + fees)
+    block := &Block{
+        PrevHash:     prevHash,
+        Timestamp:    timestamp,
+        Difficulty:   InitialDifficulty,
+        Transactions: []*Transaction{coinBase},
+    }
+    block.HashTransactions()
+    target := DifficultyToTarget(block.Difficulty)
+    for block.Hash = block.CalculateHash() ; new(big.Int).SetBytes(block.Hash).Cmp(target) >= 0 ; block.Hash = block.CalculateHash() {
+        block.Nonce++
+    }
+    return block
+}
+
+func TestReorganize(t *testing.T) {
+    dir, err := ioutil.TempDir("", "reorg")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    miner := NewWalletKeyPair().GetAddress()
+    genesis := mineTestBlock([]byte{0x0000000000000000}, 0, uint64(time.Now().Unix()), miner, 0)
+    blockChain := createBlockChain(filepath.Join(dir, DBPath), genesis, DefaultChainParams())
+    defer blockChain.Release()
+    blocks := map[string]*Block{"genesis": blockChain.GetBlockByHash(blockChain.LastBlockHash())}
+
+    steps := []struct {
+        name    string
+        parent  string
+        fees    int64
+        wantErr bool
+        wantTip string
+        connect int // 连接到主链的区块数
+    }{
+        {"m1", "genesis", 0, false, "m1", 1},
+        // 累计工作量与主链相同，保存在分支上
+        {"s1", "genesis", 0, false, "m1", 0},
+        // 分支的累计工作量超过主链，回滚 m1，连接 s1 和 s2
+        {"s2", "s1", 0, false, "s2", 2},
+        {"x1", "genesis", 0, false, "s2", 0},
+        {"x2", "x1", 0, false, "s2", 0},
+        // x3 的挖矿奖励无效，链重组失败，保持原来的主链
+        {"x3", "x2", 1, true, "s2", 0},
+    }
+    for _, step := range steps {
+        parent := blocks[step.parent]
+        block := mineTestBlock(parent.Hash, int(parent.Height)+1, parent.Timestamp+1, miner, step.fees)
+        blocks[step.name] = block
+        connected, err := blockChain.SaveBlock(block)
+        if (err != nil) != step.wantErr {
+            t.Fatalf("%s: SaveBlock() err = %v, wantErr %v", step.name, err, step.wantErr)
+        }
+        if len(connected) != step.connect {
+            t.Errorf("%s: 连接了 %d 个区块, 应为 %d 个", step.name, len(connected), step.connect)
+        }
+        if tip := blockChain.LastBlockHash(); string(tip) != string(blocks[step.wantTip].Hash) {
+            t.Fatalf("%s: 最后一个区块为 %x, 应为 %s", step.name, tip, step.wantTip)
+        }
+
+        // 只有主链上区块的挖矿交易在 UTXO 集合中
+        mainChain := make(map[string]bool)
+        for block := blockChain.GetBlockByHash(blockChain.LastBlockHash()) ; block != nil ; block = blockChain.GetBlockByHash(block.PrevHash) {
+            mainChain[string(block.Hash)] = true
+        }
+        for name, block := range blocks {
+            _, found := blockChain.GetUTXO(block.Transactions[0].TxId, 0)
+            if want := mainChain[string(block.Hash)]; found != want {
+                t.Errorf("%s: 区块 %s 的挖矿交易在 UTXO 集合中为 %v, 应为 %v", step.name, name, found, want)
+            }
+        }
+    }
+
+    if blockChain.HasBlock(blocks["x3"].Hash) {
+        t.Errorf("无效的区块 x3 没有删除")
+    }
+    if tip := blockChain.GetBlockByHash(blockChain.LastBlockHash()); tip.Height != 2 {
+        t.Errorf("主链高度为 %d, 应为 2", tip.Height)
+    }
+}
@@ -0,0 +1,609 @@
+package block
+
+import (
+    "bytes"
+    "encoding/hex"
+    "fmt"
+    "strings"
+)
+
+// 脚本系统
+// 比特币脚本的一个子集，基于栈执行
+// 锁定脚本（ScriptPubKey）规定花费 output 的条件，解锁脚本（ScriptSig）提供满足条件的数据
+// 校验时先执行解锁脚本，再使用得到的栈执行锁定脚本，最后栈顶为真时校验通过
+
+// 操作码
+const (
+    Op0                   = 0x00 // 压入空数据
+    OpPushData1           = 0x4c // 后面 1 个字节为数据长度
+    OpPushData2           = 0x4d // 后面 2 个字节为数据长度
+    Op1                   = 0x51 // 压入数字 1，OP_2 到 OP_16 依次加 1
+    Op16                  = 0x60
+    OpVerify              = 0x69
+    OpDrop                = 0x75
+    OpDup                 = 0x76
+    OpEqual               = 0x87
+    OpEqualVerify         = 0x88
+    OpHash160             = 0xa9
+    OpCheckSig            = 0xac
+    OpCheckMultiSig       = 0xae
+    OpCheckLockTimeVerify = 0xb1
+)
+
+// 操作码的名称，用于显示脚本
+var opNames = map[byte]string{
+    Op0:                   "OP_0",
+    OpPushData1:           "OP_PUSHDATA1",
+    OpPushData2:           "OP_PUSHDATA2",
+    OpVerify:              "OP_VERIFY",
+    OpDrop:                "OP_DROP",
+    OpDup:                 "OP_DUP",
+    OpEqual:               "OP_EQUAL",
+    OpEqualVerify:         "OP_EQUALVERIFY",
+    OpHash160:             "OP_HASH160",
+    OpCheckSig:            "OP_CHECKSIG",
+    OpCheckMultiSig:       "OP_CHECKMULTISIG",
+    OpCheckLockTimeVerify: "OP_CHECKLOCKTIMEVERIFY",
+}
+
+// 脚本限制
+const maxScriptSize = 10000
+const maxPushSize = 520
+const maxStackSize = 1000
+const MaxMultiSigKeys = 20
+
+// 签名类型，签名后附加 1 个字节，目前只支持对所有 input 和 output 签名
+const SigHashAll = 0x01
+
+// 地址版本号
+const PublicKeyHashAddressVersion = 0x00 // P2PKH 地址，以 1 开头
+const ScriptHashAddressVersion = 0x05    // P2SH 地址，以 3 开头
+
+// 解析后的一条指令
+type scriptOp struct {
+    opcode byte
+    data   []byte // 压入栈的数据，不是压入数据的指令时为空
+}
+
+// 判断是否为压入数据的指令
+func (op scriptOp) isPush() bool {
+    return op.opcode <= OpPushData2 || (op.opcode >= Op1 && op.opcode <= Op16)
+}
+
+// 解析脚本
+func parseScript(script []byte) ([]scriptOp, error) {
+    if len(script) > maxScriptSize {
+        return nil, fmt.Errorf("脚本长度 %d 超过上限", len(script))
+    }
+    var ops []scriptOp
+    for i := 0 ; i < len(script) ; {
+        opcode := script[i]
+        i++
+        length := 0
+        switch {
+            case opcode > Op0 && opcode < OpPushData1:
+                length = int(opcode)
+            case opcode == OpPushData1:
+                if i+1 > len(script) {
+                    return nil, fmt.Errorf("脚本不完整")
+                }
+                length = int(script[i])
+                i++
+            case opcode == OpPushData2:
+                if i+2 > len(script) {
+                    return nil, fmt.Errorf("脚本不完整")
+                }
+                length = int(script[i]) | int(script[i+1])<<8
+                i += 2
+            default:
+                ops = append(ops, scriptOp{opcode: opcode})
+                continue
+        }
+        if i+length > len(script) {
+            return nil, fmt.Errorf("脚本不完整")
+        }
+        ops = append(ops, scriptOp{opcode, script[i:i+length]})
+        i += length
+    }
+    return ops, nil
+}
+
+// 在脚本后加入压入数据的指令
+func pushData(script []byte, data []byte) []byte {
+    length := len(data)
+    switch {
+        case length == 0:
+            return append(script, Op0)
+        case length < OpPushData1:
+            script = append(script, byte(length))
+        case length <= 0xff:
+            script = append(script, OpPushData1, byte(length))
+        default:
+            script = append(script, OpPushData2, byte(length), byte(length>>8))
+    }
+    return append(script, data...)
+}
+
+// 在脚本后加入压入数字的指令，0 到 16 使用 OP_0 到 OP_16
+func pushInt(script []byte, n int64) []byte {
+    if n == 0 {
+        return append(script, Op0)
+    }
+    if n >= 1 && n <= 16 {
+        return append(script, byte(Op1 - 1 + n))
+    }
+    return pushData(script, encodeScriptNum(n))
+}
+
+// 脚本中的数字为小端序，最高位为符号位
+func encodeScriptNum(n int64) []byte {
+    if n == 0 {
+        return nil
+    }
+    negative := n < 0
+    if negative {
+        n = -n
+    }
+    var result []byte
+    for n > 0 {
+        result = append(result, byte(n & 0xff))
+        n >>= 8
+    }
+    // 最高位已被占用时增加一个字节存放符号位
+    if result[len(result)-1] & 0x80 != 0 {
+        if negative {
+            result = append(result, 0x80)
+        } else {
+            result = append(result, 0x00)
+        }
+    } else if negative {
+        result[len(result)-1] |= 0x80
+    }
+    return result
+}
+
+// 解析脚本中的数字，最多 maxLen 个字节
+func decodeScriptNum(data []byte, maxLen int) (int64, error) {
+    if len(data) > maxLen {
+        return 0, fmt.Errorf("数字长度 %d 超过上限 %d", len(data), maxLen)
+    }
+    if len(data) == 0 {
+        return 0, nil
+    }
+    var n int64
+    for i, b := range data {
+        n |= int64(b) << uint(8 * i)
+    }
+    // 处理符号位
+    if data[len(data)-1] & 0x80 != 0 {
+        n &= ^(int64(0x80) << uint(8 * (len(data) - 1)))
+        return -n, nil
+    }
+    return n, nil
+}
+
+// 栈中的数据转换成布尔值，全为 0（包括负 0）时为假
+func castToBool(data []byte) bool {
+    for i, b := range data {
+        if b != 0 {
+            // 负 0
+            if i == len(data)-1 && b == 0x80 {
+                return false
+            }
+            return true
+        }
+    }
+    return false
+}
+
+// 将脚本转换成可读的格式
+func DisassembleScript(script []byte) string {
+    ops, err := parseScript(script)
+    if err != nil {
+        return fmt.Sprintf("[无效脚本 %x]", script)
+    }
+    var parts []string
+    for _, op := range ops {
+        switch {
+            case op.opcode >= Op1 && op.opcode <= Op16:
+                parts = append(parts, fmt.Sprintf("OP_%d", op.opcode - Op1 + 1))
+            case op.opcode > Op0 && op.opcode <= OpPushData2:
+                parts = append(parts, hex.EncodeToString(op.data))
+            default:
+                name, ok := opNames[op.opcode]
+                if !ok {
+                    name = fmt.Sprintf("OP_UNKNOWN_%#x", op.opcode)
+                }
+                parts = append(parts, name)
+        }
+    }
+    return strings.Join(parts, " ")
+}
+
+// P2PKH 锁定脚本
+// OP_DUP OP_HASH160 <公钥哈希> OP_EQUALVERIFY OP_CHECKSIG
+func PayToPublicKeyHashScript(publicKeyHash []byte) []byte {
+    script := []byte{OpDup, OpHash160}
+    script = pushData(script, publicKeyHash)
+    return append(script, OpEqualVerify, OpCheckSig)
+}
+
+// P2SH 锁定脚本
+// OP_HASH160 <赎回脚本哈希> OP_EQUAL
+func PayToScriptHashScript(scriptHash []byte) []byte {
+    script := []byte{OpHash160}
+    script = pushData(script, scriptHash)
+    return append(script, OpEqual)
+}
+
+// 多重签名脚本，需要 n 个公钥中的 m 个签名
+// OP_m <公钥1> ... <公钥n> OP_n OP_CHECKMULTISIG
+func MultiSigScript(m int, publicKeys [][]byte) ([]byte, error) {
+    n := len(publicKeys)
+    if n == 0 || n > 16 {
+        return nil, fmt.Errorf("公钥数量必须在 1 到 16 之间")
+    }
+    if m < 1 || m > n {
+        return nil, fmt.Errorf("签名数量必须在 1 到 %d 之间", n)
+    }
+    script := pushInt(nil, int64(m))
+    for _, publicKey := range publicKeys {
+        script = pushData(script, publicKey)
+    }
+    script = pushInt(script, int64(n))
+    return append(script, OpCheckMultiSig), nil
+}
+
+// 判断是否为 P2PKH 锁定脚本，是时返回公钥哈希
+func extractPublicKeyHash(script []byte) []byte {
+    if len(script) == 25 && script[0] == OpDup && script[1] == OpHash160 && script[2] == 20 &&
+        script[23] == OpEqualVerify && script[24] == OpCheckSig {
+        return script[3:23]
+    }
+    return nil
+}
+
+// 判断是否为 P2SH 锁定脚本，是时返回赎回脚本哈希
+func extractScriptHash(script []byte) []byte {
+    if len(script) == 23 && script[0] == OpHash160 && script[1] == 20 && script[22] == OpEqual {
+        return script[2:22]
+    }
+    return nil
+}
+
+// 解析多重签名脚本，返回需要的签名数和所有公钥
+func extractMultiSig(script []byte) (int, [][]byte, bool) {
+    ops, err := parseScript(script)
+    if err != nil || len(ops) < 4 || ops[len(ops)-1].opcode != OpCheckMultiSig {
+        return 0, nil, false
+    }
+    first := ops[0].opcode
+    last := ops[len(ops)-2].opcode
+    if first < Op1 || first > Op16 || last < Op1 || last > Op16 {
+        return 0, nil, false
+    }
+    m := int(first - Op1 + 1)
+    n := int(last - Op1 + 1)
+    if n != len(ops) - 3 || m > n {
+        return 0, nil, false
+    }
+    var publicKeys [][]byte
+    for _, op := range ops[1:len(ops)-2] {
+        if op.opcode == Op0 || op.opcode > OpPushData2 {
+            return 0, nil, false
+        }
+        publicKeys = append(publicKeys, op.data)
+    }
+    return m, publicKeys, true
+}
+
+// 根据地址生成锁定脚本
+// 以 1 开头的地址使用 P2PKH，以 3 开头的地址使用 P2SH
+func LockScript(address string) []byte {
+    version, hash := decodeAddress(address)
+    if version == ScriptHashAddressVersion {
+        return PayToScriptHashScript(hash)
+    }
+    return PayToPublicKeyHashScript(hash)
+}
+
+// 根据锁定脚本获取地址，不是 P2PKH 或 P2SH 时返回空字符串
+func ScriptAddress(script []byte) string {
+    if hash := extractPublicKeyHash(script); hash != nil {
+        return encodeAddress(PublicKeyHashAddressVersion, hash)
+    }
+    if hash := extractScriptHash(script); hash != nil {
+        return encodeAddress(ScriptHashAddressVersion, hash)
+    }
+    return ""
+}
+
+// 执行脚本的虚拟机
+type scriptEngine struct {
+    tx         *Transaction
+    index      int       // 校验的 input 索引
+    prevOutput *TxOutput // input 引用的 output
+    stack      [][]byte
+}
+
+func (engine *scriptEngine) push(data []byte) error {
+    if len(engine.stack) >= maxStackSize {
+        return fmt.Errorf("栈的大小超过上限")
+    }
+    engine.stack = append(engine.stack, data)
+    return nil
+}
+
+func (engine *scriptEngine) pop() ([]byte, error) {
+    if len(engine.stack) == 0 {
+        return nil, fmt.Errorf("栈为空")
+    }
+    data := engine.stack[len(engine.stack)-1]
+    engine.stack = engine.stack[:len(engine.stack)-1]
+    return data, nil
+}
+
+func (engine *scriptEngine) peek() ([]byte, error) {
+    if len(engine.stack) == 0 {
+        return nil, fmt.Errorf("栈为空")
+    }
+    return engine.stack[len(engine.stack)-1], nil
+}
+
+func (engine *scriptEngine) popInt() (int64, error) {
+    data, err := engine.pop()
+    if err != nil {
+        return 0, err
+    }
+    return decodeScriptNum(data, 4)
+}
+
+// 执行脚本
+func (engine *scriptEngine) execute(script []byte) error {
+    ops, err := parseScript(script)
+    if err != nil {
+        return err
+    }
+    for _, op := range ops {
+        if op.isPush() {
+            data := op.data
+            if op.opcode >= Op1 && op.opcode <= Op16 {
+                data = encodeScriptNum(int64(op.opcode - Op1 + 1))
+            }
+            if len(data) > maxPushSize {
+                return fmt.Errorf("压入的数据长度 %d 超过上限", len(data))
+            }
+            if err := engine.push(data); err != nil {
+                return err
+            }
+            continue
+        }
+        if err := engine.executeOp(op.opcode, script); err != nil {
+            return fmt.Errorf("%s: %v", opNames[op.opcode], err)
+        }
+    }
+    return nil
+}
+
+// 执行一条指令，script 为正在执行的脚本，签名时使用
+func (engine *scriptEngine) executeOp(opcode byte, script []byte) error {
+    switch opcode {
+        case OpVerify:
+            data, err := engine.pop()
+            if err != nil {
+                return err
+            }
+            if !castToBool(data) {
+                return fmt.Errorf("校验失败")
+            }
+        case OpDrop:
+            _, err := engine.pop()
+            return err
+        case OpDup:
+            data, err := engine.peek()
+            if err != nil {
+                return err
+            }
+            return engine.push(data)
+        case OpEqual, OpEqualVerify:
+            a, err := engine.pop()
+            if err != nil {
+                return err
+            }
+            b, err := engine.pop()
+            if err != nil {
+                return err
+            }
+            equal := bytes.Equal(a, b)
+            if opcode == OpEqualVerify {
+                if !equal {
+                    return fmt.Errorf("数据不相等")
+                }
+                return nil
+            }
+            return engine.push(boolToBytes(equal))
+        case OpHash160:
+            data, err := engine.pop()
+            if err != nil {
+                return err
+            }
+            return engine.push(HashPublicKey(data))
+        case OpCheckSig:
+            publicKey, err := engine.pop()
+            if err != nil {
+                return err
+            }
+            signature, err := engine.pop()
+            if err != nil {
+                return err
+            }
+            return engine.push(boolToBytes(engine.checkSignature(signature, publicKey, script)))
+        case OpCheckMultiSig:
+            return engine.checkMultiSig(script)
+        case OpCheckLockTimeVerify:
+            data, err := engine.peek()
+            if err != nil {
+                return err
+            }
+            lockTime, err := decodeScriptNum(data, 5)
+            if err != nil {
+                return err
+            }
+            if lockTime < 0 {
+                return fmt.Errorf("锁定时间不能为负数")
+            }
+            // 锁定时间的类型必须与交易的锁定时间相同，都是区块高度或都是时间戳
+            txLockTime := int64(engine.tx.LockTime)
+            if (lockTime < LockTimeThreshold) != (txLockTime < LockTimeThreshold) {
+                return fmt.Errorf("锁定时间 %d 与交易的锁定时间 %d 类型不同", lockTime, txLockTime)
+            }
+            if lockTime > txLockTime {
+                return fmt.Errorf("交易的锁定时间 %d 小于 %d", txLockTime, lockTime)
+            }
+            // 序列号为最大值时交易的锁定时间不生效
+            if engine.tx.TxInputs[engine.index].Sequence == MaxSequence {
+                return fmt.Errorf("input 的序列号为 %#x, 交易的锁定时间不生效", uint32(MaxSequence))
+            }
+        default:
+            return fmt.Errorf("不支持的操作码 %#x", opcode)
+    }
+    return nil
+}
+
+func boolToBytes(value bool) []byte {
+    if value {
+        return []byte{1}
+    }
+    return nil
+}
+
+// OP_CHECKMULTISIG
+// 栈中依次为 <空> <签名1> ... <签名m> m <公钥1> ... <公钥n> n
+// 签名的顺序必须与公钥的顺序一致
+func (engine *scriptEngine) checkMultiSig(script []byte) error {
+    n, err := engine.popInt()
+    if err != nil {
+        return err
+    }
+    if n < 0 || n > MaxMultiSigKeys {
+        return fmt.Errorf("公钥数量 %d 无效", n)
+    }
+    publicKeys := make([][]byte, n)
+    for i := int(n) - 1 ; i >= 0 ; i-- {
+        publicKeys[i], err = engine.pop()
+        if err != nil {
+            return err
+        }
+    }
+    m, err := engine.popInt()
+    if err != nil {
+        return err
+    }
+    if m < 0 || m > n {
+        return fmt.Errorf("签名数量 %d 无效", m)
+    }
+    signatures := make([][]byte, m)
+    for i := int(m) - 1 ; i >= 0 ; i-- {
+        signatures[i], err = engine.pop()
+        if err != nil {
+            return err
+        }
+    }
+    // 与比特币一致，多弹出一个元素，必须为空
+    dummy, err := engine.pop()
+    if err != nil {
+        return err
+    }
+    if len(dummy) != 0 {
+        return fmt.Errorf("多余的元素必须为空")
+    }
+
+    success := true
+    keyIndex := 0
+    for _, signature := range signatures {
+        // 依次查找与签名匹配的公钥
+        for keyIndex < len(publicKeys) && !engine.checkSignature(signature, publicKeys[keyIndex], script) {
+            keyIndex++
+        }
+        if keyIndex == len(publicKeys) {
+            success = false
+            break
+        }
+        keyIndex++
+    }
+    return engine.push(boolToBytes(success))
+}
+
+// 校验签名
+func (engine *scriptEngine) checkSignature(signature, publicKey, script []byte) bool {
+    return verifyScriptSignature(publicKey, signature, engine.tx.SigHash(engine.index, script))
+}
+
+// 校验脚本中的签名，签名末尾为签名类型
+func verifyScriptSignature(publicKey, signature, signData []byte) bool {
+    if len(signature) == 0 || signature[len(signature)-1] != SigHashAll {
+        return false
+    }
+    return verifySignature(publicKey, signature[:len(signature)-1], signData)
+}
+
+// 判断脚本是否只包含压入数据的指令
+func isPushOnly(script []byte) bool {
+    ops, err := parseScript(script)
+    if err != nil {
+        return false
+    }
+    for _, op := range ops {
+        if !op.isPush() {
+            return false
+        }
+    }
+    return true
+}
+
+// 校验 input 的解锁脚本能否解锁引用的 output
+// 1.执行解锁脚本
+// 2.使用得到的栈执行锁定脚本，栈顶必须为真
+// 3.锁定脚本为 P2SH 时，解锁脚本的最后一个数据为赎回脚本，使用剩下的栈执行赎回脚本
+func VerifyScript(tx *Transaction, index int, prevOutput *TxOutput) error {
+    unlockScript := tx.TxInputs[index].ScriptSig
+    lockScript := prevOutput.LockScript()
+    if !isPushOnly(unlockScript) {
+        return fmt.Errorf("解锁脚本只能包含压入数据的指令")
+    }
+
+    engine := &scriptEngine{tx: tx, index: index, prevOutput: prevOutput}
+    err := engine.execute(unlockScript)
+    if err != nil {
+        return fmt.Errorf("执行解锁脚本失败: %v", err)
+    }
+    // 保存执行解锁脚本后的栈，P2SH 时使用
+    stack := append([][]byte{}, engine.stack...)
+
+    err = engine.execute(lockScript)
+    if err != nil {
+        return fmt.Errorf("执行锁定脚本失败: %v", err)
+    }
+    top, err := engine.peek()
+    if err != nil || !castToBool(top) {
+        return fmt.Errorf("锁定脚本执行结果为假")
+    }
+
+    if extractScriptHash(lockScript) == nil {
+        return nil
+    }
+    if len(stack) == 0 {
+        return fmt.Errorf("缺少赎回脚本")
+    }
+    redeemScript := stack[len(stack)-1]
+    engine.stack = stack[:len(stack)-1]
+    err = engine.execute(redeemScript)
+    if err != nil {
+        return fmt.Errorf("执行赎回脚本失败: %v", err)
+    }
+    top, err = engine.peek()
+    if err != nil || !castToBool(top) {
+        return fmt.Errorf("赎回脚本执行结果为假")
+    }
+    return nil
+}
@@ -0,0 +1,147 @@
+package block
+
+import (
+    "github.com/decred/dcrd/dcrec/secp256k1/v4"
+    "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+    "testing"
+)
+
+// 生成测试用的私钥
+func newTestKey(t *testing.T) *secp256k1.PrivateKey {
+    privateKey, err := secp256k1.GeneratePrivateKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    return privateKey
+}
+
+// 对 input 0 签名，subscript 为锁定脚本或赎回脚本，末尾加上签名类型
+func signTestInput(tx *Transaction, privateKey *secp256k1.PrivateKey, subscript []byte) []byte {
+    return append(ecdsa.Sign(privateKey, tx.SigHash(0, subscript)).Serialize(), SigHashAll)
+}
+
+func TestVerifyScript(t *testing.T) {
+    key1, key2, key3 := newTestKey(t), newTestKey(t), newTestKey(t)
+    pub1 := key1.PubKey().SerializeCompressed()
+    pub2 := key2.PubKey().SerializeCompressed()
+    pub3 := key3.PubKey().SerializeCompressed()
+
+    p2pkh := PayToPublicKeyHashScript(HashPublicKey(pub1))
+    multiSig, err := MultiSigScript(2, [][]byte{pub1, pub2, pub3})
+    if err != nil {
+        t.Fatal(err)
+    }
+    p2sh := PayToScriptHashScript(HashPublicKey(multiSig))
+    bareMultiSig, err := MultiSigScript(1, [][]byte{pub1, pub2})
+    if err != nil {
+        t.Fatal(err)
+    }
+    // <锁定时间> OP_CHECKLOCKTIMEVERIFY OP_DROP 之后为 P2PKH
+    cltv := append(pushInt(nil, 100), OpCheckLockTimeVerify, OpDrop)
+    cltv = append(cltv, p2pkh...)
+    p2shCLTV := PayToScriptHashScript(HashPublicKey(cltv))
+
+    tests := []struct {
+        name       string
+        lockTime   uint64
+        sequence   uint32
+        lockScript []byte
+        scriptSig  func(tx *Transaction) []byte
+        wantErr    bool
+    }{
+        {"P2PKH", 0, MaxSequence, p2pkh, func(tx *Transaction) []byte {
+            return pushData(pushData(nil, signTestInput(tx, key1, p2pkh)), pub1)
+        }, false},
+        {"P2PKH 公钥不匹配", 0, MaxSequence, p2pkh, func(tx *Transaction) []byte {
+            return pushData(pushData(nil, signTestInput(tx, key2, p2pkh)), pub2)
+        }, true},
+        {"P2PKH 签名的私钥错误", 0, MaxSequence, p2pkh, func(tx *Transaction) []byte {
+            return pushData(pushData(nil, signTestInput(tx, key2, p2pkh)), pub1)
+        }, true},
+        {"P2PKH 签名数据错误", 0, MaxSequence, p2pkh, func(tx *Transaction) []byte {
+            return pushData(pushData(nil, signTestInput(tx, key1, p2sh)), pub1)
+        }, true},
+        {"P2PKH 解锁脚本包含其他指令", 0, MaxSequence, p2pkh, func(tx *Transaction) []byte {
+            return append(pushData(pushData(nil, signTestInput(tx, key1, p2pkh)), pub1), OpDup)
+        }, true},
+        {"P2SH 多重签名", 0, MaxSequence, p2sh, func(tx *Transaction) []byte {
+            script := pushData([]byte{Op0}, signTestInput(tx, key1, multiSig))
+            script = pushData(script, signTestInput(tx, key3, multiSig))
+            return pushData(script, multiSig)
+        }, false},
+        {"P2SH 多重签名顺序错误", 0, MaxSequence, p2sh, func(tx *Transaction) []byte {
+            script := pushData([]byte{Op0}, signTestInput(tx, key3, multiSig))
+            script = pushData(script, signTestInput(tx, key1, multiSig))
+            return pushData(script, multiSig)
+        }, true},
+        {"P2SH 多重签名数量不足", 0, MaxSequence, p2sh, func(tx *Transaction) []byte {
+            script := pushData([]byte{Op0}, signTestInput(tx, key1, multiSig))
+            return pushData(script, multiSig)
+        }, true},
+        {"P2SH 赎回脚本错误", 0, MaxSequence, p2sh, func(tx *Transaction) []byte {
+            script := pushData([]byte{Op0}, signTestInput(tx, key1, bareMultiSig))
+            return pushData(script, bareMultiSig)
+        }, true},
+        {"多重签名", 0, MaxSequence, bareMultiSig, func(tx *Transaction) []byte {
+            return pushData([]byte{Op0}, signTestInput(tx, key2, bareMultiSig))
+        }, false},
+        {"多重签名多余的元素不为空", 0, MaxSequence, bareMultiSig, func(tx *Transaction) []byte {
+            return pushData(pushData(nil, []byte{1}), signTestInput(tx, key2, bareMultiSig))
+        }, true},
+        {"CLTV", 100, MaxSequence - 1, p2shCLTV, func(tx *Transaction) []byte {
+            return pushData(pushData(pushData(nil, signTestInput(tx, key1, cltv)), pub1), cltv)
+        }, false},
+        {"CLTV 锁定时间未到", 99, MaxSequence - 1, p2shCLTV, func(tx *Transaction) []byte {
+            return pushData(pushData(pushData(nil, signTestInput(tx, key1, cltv)), pub1), cltv)
+        }, true},
+        {"CLTV 锁定时间类型不同", LockTimeThreshold + 100, MaxSequence - 1, p2shCLTV, func(tx *Transaction) []byte {
+            return pushData(pushData(pushData(nil, signTestInput(tx, key1, cltv)), pub1), cltv)
+        }, true},
+        {"CLTV 序列号为最大值", 100, MaxSequence, p2shCLTV, func(tx *Transaction) []byte {
+            return pushData(pushData(pushData(nil, signTestInput(tx, key1, cltv)), pub1), cltv)
+        }, true},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            tx := &Transaction{
+                TxInputs:  []TxInput{{TxId: []byte("prev"), Index: 0, Sequence: test.sequence}},
+                TxOutputs: []TxOutput{{Value: 1000, ScriptPubKey: p2pkh}},
+                Version:   TxVersion,
+                LockTime:  test.lockTime,
+            }
+            tx.TxInputs[0].ScriptSig = test.scriptSig(tx)
+            prevOutput := &TxOutput{Value: 2000, ScriptPubKey: test.lockScript}
+            err := VerifyScript(tx, 0, prevOutput)
+            if (err != nil) != test.wantErr {
+                t.Errorf("VerifyScript() err = %v, wantErr %v", err, test.wantErr)
+            }
+        })
+    }
+}
+
+func TestScriptNum(t *testing.T) {
+    tests := []struct {
+        n    int64
+        want []byte
+    }{
+        {0, nil},
+        {1, []byte{0x01}},
+        {-1, []byte{0x81}},
+        {127, []byte{0x7f}},
+        {128, []byte{0x80, 0x00}},
+        {-128, []byte{0x80, 0x80}},
+        {255, []byte{0xff, 0x00}},
+        {256, []byte{0x00, 0x01}},
+        {LockTimeThreshold, []byte{0x00, 0x65, 0xcd, 0x1d}},
+    }
+    for _, test := range tests {
+        data := encodeScriptNum(test.n)
+        if string(data) != string(test.want) {
+            t.Errorf("encodeScriptNum(%d) = %x, want %x", test.n, data, test.want)
+        }
+        n, err := decodeScriptNum(data, 5)
+        if err != nil || n != test.n {
+            t.Errorf("decodeScriptNum(%x) = %d, %v, want %d", data, n, err, test.n)
+        }
+    }
+}
@@ -0,0 +1,137 @@
+package block
+
+import (
+    "bytes"
+    "encoding/gob"
+    "fmt"
+    "github.com/boltdb/bolt"
+    "log"
+)
+
+// 挖矿奖励减半
+// 挖矿奖励由区块高度决定，每隔 HalvingInterval 个区块减半，发行总量有上限
+// 初始挖矿奖励和减半间隔是链参数，创建区块链时指定并保存在数据库中，之后不能修改
+
+// 默认的初始挖矿奖励 12.5 个币
+const DefaultInitialSubsidy = 12.5 * SatoshiPerCoin
+
+// 默认每隔多少个区块奖励减半
+const DefaultHalvingInterval = 210
+
+// 数据库中保存链参数的 key
+const ChainParamsKey = "chain_params"
+
+// 链参数
+type ChainParams struct {
+    InitialSubsidy  int64 // 初始挖矿奖励，单位为聪
+    HalvingInterval int   // 每隔多少个区块奖励减半
+}
+
+// 默认的链参数，旧版本的数据库没有保存链参数时使用
+func DefaultChainParams() *ChainParams {
+    return &ChainParams{InitialSubsidy: DefaultInitialSubsidy, HalvingInterval: DefaultHalvingInterval}
+}
+
+// 创建链参数，initialSubsidy 为初始挖矿奖励（币），halvingInterval 为减半间隔
+func NewChainParams(initialSubsidy string, halvingInterval int) (*ChainParams, error) {
+    subsidy, err := ParseAmount(initialSubsidy)
+    if err != nil {
+        return nil, fmt.Errorf("初始挖矿奖励%v", err)
+    }
+    if subsidy <= 0 {
+        return nil, fmt.Errorf("初始挖矿奖励必须大于 0")
+    }
+    if halvingInterval <= 0 {
+        return nil, fmt.Errorf("减半间隔必须大于 0")
+    }
+    // 发行总量小于 2 * 初始挖矿奖励 * 减半间隔，不能超过金额上限
+    if int64(halvingInterval) > MaxAmount/(2*subsidy) {
+        return nil, fmt.Errorf("初始挖矿奖励 %s 和减半间隔 %d 的发行总量超过上限 %s", FormatAmount(subsidy), halvingInterval, FormatAmount(MaxAmount))
+    }
+    return &ChainParams{InitialSubsidy: subsidy, HalvingInterval: halvingInterval}, nil
+}
+
+// 链参数序列化
+func (params *ChainParams) ToBytes() []byte {
+    var buffer bytes.Buffer
+    encoder := gob.NewEncoder(&buffer)
+    err := encoder.Encode(params)
+    if err != nil {
+        log.Panic(err)
+    }
+    return buffer.Bytes()
+}
+
+// 链参数反序列化
+func (params *ChainParams) ToChainParams(data []byte) {
+    decoder := gob.NewDecoder(bytes.NewReader(data))
+    err := decoder.Decode(params)
+    if err != nil {
+        log.Panic(err)
+    }
+}
+
+// 读取数据库中的链参数，没有保存时使用默认值
+func loadChainParams(bucket *bolt.Bucket) *ChainParams {
+    value := bucket.Get([]byte(ChainParamsKey))
+    if value == nil {
+        return DefaultChainParams()
+    }
+    params := &ChainParams{}
+    params.ToChainParams(value)
+    return params
+}
+
+// 链参数
+func (blockChain *BlockChain) Params() *ChainParams {
+    return blockChain.params
+}
+
+// 计算高度为 height 的区块的挖矿奖励
+func BlockSubsidy(params *ChainParams, height int) int64 {
+    halvings := uint(height / params.HalvingInterval)
+    // 右移 64 位以上结果为 0
+    if halvings >= 64 {
+        return 0
+    }
+    return params.InitialSubsidy >> halvings
+}
+
+// 计算从创世块到高度为 height 的区块按规则发行的总量
+func TotalSupply(params *ChainParams, height int) int64 {
+    var total int64
+    for start := 0; start <= height; start += params.HalvingInterval {
+        subsidy := BlockSubsidy(params, start)
+        if subsidy == 0 {
+            break
+        }
+        // 这一阶段的区块数
+        count := params.HalvingInterval
+        if height-start+1 < count {
+            count = height - start + 1
+        }
+        total += subsidy * int64(count)
+    }
+    return total
+}
+
+// 发行总量上限
+func MaxSupply(params *ChainParams) int64 {
+    return TotalSupply(params, 64 * params.HalvingInterval)
+}
+
+// 实际发行量
+// 手续费只是从交易转移到挖矿交易，所以所有 UTXO 的金额之和就是挖矿交易实际领取的奖励之和
+func (blockChain *BlockChain) IssuedSupply() int64 {
+    var total int64
+    blockChain.view(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket([]byte(UTXOBucketName))
+        return bucket.ForEach(func(key, value []byte) error {
+            for _, UTXOInfo := range bytesToUTXOs(value) {
+                total += UTXOInfo.Output.Value
+            }
+            return nil
+        })
+    })
+    return total
+}
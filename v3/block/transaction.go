@@ -2,14 +2,13 @@ package block
 
 import (
     "bytes"
-    "crypto/ecdsa"
-    "crypto/elliptic"
     "crypto/rand"
     "crypto/sha256"
     "encoding/gob"
     "fmt"
+    "github.com/decred/dcrd/dcrec/secp256k1/v4"
+    "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
     "log"
-    "math/big"
     "strings"
 )
 
@@ -22,22 +21,31 @@ import (
 // 交易输出
 // 包含资金接收方的相关信息
 // 交易金额
-// 锁定脚本（对方公钥的哈希值）
+// 锁定脚本（例如对方公钥的哈希值）
+
+// 交易版本
+// 旧版本的交易使用签名、公钥和公钥哈希，版本 1 的交易使用脚本，版本 2 的交易增加了锁定时间和序列号
+const LegacyTxVersion = 0
+const ScriptTxVersion = 1
+const TxVersion = 2
 
 // 输入交易
 type TxInput struct {
     TxId  []byte // 交易 id
     Index int    // output 的索引
     // Address string // 解锁脚本，先使用地址来模拟
-    Signature []byte // 签名
-    PublicKey []byte // 公钥
+    Signature []byte // 签名，旧版本的交易使用
+    PublicKey []byte // 公钥，旧版本的交易使用
+    ScriptSig []byte // 解锁脚本
+    Sequence  uint32 // 序列号，用于相对锁定时间
 }
 
 // 输出交易
 type TxOutput struct {
-    Value float64 // 转账金额
+    Value int64 // 转账金额，单位为聪
     // Address string  // 锁定脚本
-    PublicKeyHash []byte // 公钥哈希
+    PublicKeyHash []byte // 公钥哈希，旧版本的交易使用
+    ScriptPubKey  []byte // 锁定脚本
 }
 
 // 交易结构
@@ -45,27 +53,190 @@ type Transaction struct {
     TxId      []byte     // 交易 id
     TxInputs  []TxInput  // 所有 inputs
     TxOutputs []TxOutput // 所有 outputs
+    Version   int        // 交易版本
+    LockTime  uint64     // 锁定时间，区块高度或时间戳
 }
 
 // UTXO 结构
 type UTXOInfo struct {
-    TxId   []byte   // 交易 id
-    Index  int      // output 索引
-    Output TxOutput // output
+    TxId     []byte   // 交易 id
+    Index    int      // output 索引
+    Output   TxOutput // output
+    Height   uint64   // 交易所在的区块高度
+    CoinBase bool     // 是否为挖矿交易的 output
 }
 
 // 设置交易 id
 // 对 Transaction 进行 hash 运算
 func (tx *Transaction) SetTxID() {
-    // 使用 gob 对 tx 序列化
+    tx.TxId = tx.CalculateTxID()
+}
+
+// 序列化交易，用于计算交易 id 和签名数据
+// 除挖矿交易外，解锁脚本不参与计算，交易 id 在签名前后保持不变
+// 签名时索引为 signIndex 的 input 使用 subscript 代替解锁脚本，计算交易 id 时 signIndex 为 -1
+func (tx *Transaction) serialize(signIndex int, subscript []byte) []byte {
+    var buffer bytes.Buffer
+    writeUint64(&buffer, uint64(tx.Version))
+    writeUint64(&buffer, uint64(len(tx.TxInputs)))
+    for i, input := range tx.TxInputs {
+        writeBytes(&buffer, input.TxId)
+        writeUint64(&buffer, uint64(int64(input.Index)))
+        switch {
+            case i == signIndex:
+                writeBytes(&buffer, subscript)
+            case signIndex < 0 && tx.IsCoinBase():
+                writeBytes(&buffer, input.ScriptSig)
+            default:
+                writeBytes(&buffer, nil)
+        }
+        if tx.Version >= TxVersion {
+            writeUint64(&buffer, uint64(input.Sequence))
+        }
+    }
+    writeUint64(&buffer, uint64(len(tx.TxOutputs)))
+    for _, output := range tx.TxOutputs {
+        writeUint64(&buffer, uint64(output.Value))
+        writeBytes(&buffer, output.ScriptPubKey)
+    }
+    if tx.Version >= TxVersion {
+        writeUint64(&buffer, tx.LockTime)
+    }
+    return buffer.Bytes()
+}
+
+func writeUint64(buffer *bytes.Buffer, num uint64) {
+    buffer.Write(uint64ToBytes(num))
+}
+
+// 写入长度和数据
+func writeBytes(buffer *bytes.Buffer, data []byte) {
+    writeUint64(buffer, uint64(len(data)))
+    buffer.Write(data)
+}
+
+// 计算签名数据
+// index 为签名的 input，subscript 为引用的 output 的锁定脚本，P2SH 时为赎回脚本
+func (tx *Transaction) SigHash(index int, subscript []byte) []byte {
+    data := tx.serialize(index, subscript)
+    data = append(data, SigHashAll)
+    hash := sha256.Sum256(data)
+    return hash[:]
+}
+
+// 检查交易格式
+// 旧版本的交易不能使用脚本，新版本的交易不能使用旧版本的字段，否则这些字段不在交易 id 和签名的范围内
+// 同样，版本 2 之前的交易不能使用锁定时间和序列号
+func (tx *Transaction) checkFormat() error {
+    switch tx.Version {
+        case LegacyTxVersion:
+            for _, input := range tx.TxInputs {
+                if input.ScriptSig != nil {
+                    return fmt.Errorf("旧版本的交易不能使用解锁脚本")
+                }
+            }
+            for _, output := range tx.TxOutputs {
+                if output.ScriptPubKey != nil {
+                    return fmt.Errorf("旧版本的交易不能使用锁定脚本")
+                }
+            }
+        case ScriptTxVersion, TxVersion:
+            for _, input := range tx.TxInputs {
+                if input.Signature != nil || input.PublicKey != nil {
+                    return fmt.Errorf("新版本的交易只能使用解锁脚本")
+                }
+            }
+            for _, output := range tx.TxOutputs {
+                if output.PublicKeyHash != nil || output.ScriptPubKey == nil {
+                    return fmt.Errorf("新版本的交易只能使用锁定脚本")
+                }
+            }
+        default:
+            return fmt.Errorf("不支持的交易版本 %d", tx.Version)
+    }
+    if tx.Version < TxVersion {
+        if tx.LockTime != 0 {
+            return fmt.Errorf("版本 %d 的交易不能使用锁定时间", tx.Version)
+        }
+        for _, input := range tx.TxInputs {
+            if input.Sequence != 0 {
+                return fmt.Errorf("版本 %d 的交易不能使用序列号", tx.Version)
+            }
+        }
+    }
+    return nil
+}
+
+// 获取 input 解锁的公钥哈希或脚本哈希，即解锁脚本中最后一个数据的哈希
+func (input *TxInput) LockedHash() []byte {
+    if input.ScriptSig == nil {
+        return HashPublicKey(input.PublicKey)
+    }
+    ops, err := parseScript(input.ScriptSig)
+    if err != nil || len(ops) == 0 {
+        return nil
+    }
+    return HashPublicKey(ops[len(ops)-1].data)
+}
+
+// 获取 input 花费的地址
+// 解锁脚本的最后一个数据为公钥时是 P2PKH 地址，否则为赎回脚本，是 P2SH 地址
+func (input *TxInput) Address() string {
+    if input.ScriptSig == nil {
+        return encodeAddress(PublicKeyHashAddressVersion, HashPublicKey(input.PublicKey))
+    }
+    ops, err := parseScript(input.ScriptSig)
+    if err != nil || len(ops) == 0 {
+        return ""
+    }
+    data := ops[len(ops)-1].data
+    if _, err := secp256k1.ParsePubKey(data); err == nil {
+        return encodeAddress(PublicKeyHashAddressVersion, HashPublicKey(data))
+    }
+    return encodeAddress(ScriptHashAddressVersion, HashPublicKey(data))
+}
+
+// 获取 output 的锁定脚本
+// 旧版本的 output 只有公钥哈希，相当于 P2PKH 锁定脚本
+func (output *TxOutput) LockScript() []byte {
+    if output.ScriptPubKey == nil {
+        return PayToPublicKeyHashScript(output.PublicKeyHash)
+    }
+    return output.ScriptPubKey
+}
+
+// 获取锁定脚本中的公钥哈希或脚本哈希，其他脚本返回空
+func (output *TxOutput) LockedHash() []byte {
+    script := output.LockScript()
+    if hash := extractPublicKeyHash(script); hash != nil {
+        return hash
+    }
+    return extractScriptHash(script)
+}
+
+// 获取 output 的地址，其他脚本返回空字符串
+func (output *TxOutput) Address() string {
+    return ScriptAddress(output.LockScript())
+}
+
+// gob 序列化
+func (tx *Transaction) ToBytes() []byte {
     var buffer bytes.Buffer
     encoder := gob.NewEncoder(&buffer)
     err := encoder.Encode(tx)
     if err != nil {
         log.Panic(err)
     }
-    hash := sha256.Sum256(buffer.Bytes())
-    tx.TxId = hash[:]
+    return buffer.Bytes()
+}
+
+// gob 反序列化
+func (tx *Transaction) ToTransaction(data []byte) {
+    decoder := gob.NewDecoder(bytes.NewReader(data))
+    err := decoder.Decode(tx)
+    if err != nil {
+        log.Panic(err)
+    }
 }
 
 // 判断是否为挖矿交易
@@ -81,18 +252,36 @@ func (tx *Transaction) IsCoinBase() bool {
     return false
 }
 
-const reward = 12.5
+// 输出总金额，金额无效或溢出时返回错误
+func (tx *Transaction) OutputValue() (int64, error) {
+    var total int64
+    for _, output := range tx.TxOutputs {
+        var err error
+        total, err = AddAmount(total, output.Value)
+        if err != nil {
+            return 0, err
+        }
+    }
+    return total, nil
+}
 
 // 挖矿交易
-// 传入挖矿人
-func NewCoinBaseTx(miner string, data string) *Transaction {
+// 传入挖矿人，以及挖矿奖励加上区块中所有交易的手续费
+func NewCoinBaseTx(miner string, data string, value int64) *Transaction {
     // 在之后的程序中需要识别一个交易是否为 CoinBase ，所以初始化一些特殊值
     //inputs := []TxInput{{nil, -1, data}}
     //outputs := []TxOutput{{12.5, miner}}
-    inputs := []TxInput{{nil, -1, nil, []byte(data)}}
-    outputs := []TxOutput{{reward, Lock(miner)}}
+    // 在 data 后加入随机数，避免同一个矿工的挖矿交易 id 相同
+    extraNonce := make([]byte, 8)
+    _, err := rand.Read(extraNonce)
+    if err != nil {
+        log.Panic(err)
+    }
+    inputs := []TxInput{{TxId: nil, Index: -1, ScriptSig: append([]byte(data), extraNonce...), Sequence: MaxSequence}}
+    // 矿工获得挖矿奖励和手续费
+    outputs := []TxOutput{{Value: value, ScriptPubKey: LockScript(miner)}}
 
-    tx := &Transaction{nil, inputs, outputs}
+    tx := &Transaction{TxInputs: inputs, TxOutputs: outputs, Version: TxVersion}
     tx.SetTxID()
     return tx
 }
@@ -102,32 +291,102 @@ func NewCoinBaseTx(miner string, data string) *Transaction {
 // 2.如果金额不足以转账，创建交易失败
 // 3.将 outputs 转成 inputs
 // 4.创建属于收款人的 output
-// 5.如果有找零，创建属于付款人的 output
+// 5.如果有找零，创建属于付款人的 output，输入减去输出的部分作为手续费
 // 6.设置交易 id
 // 7.返回交易结构
-func NewTransaction(from, to string, amount float64, blockChain *BlockChain) *Transaction {
-    // 能用的 UTXO
-    UTXOs := make(map[string][]int)
-    // UTXO 存储的金额
-    resValue := 0.0
-
-    // 获取钱包，找出公钥和私钥
+// 钱包加密时需要输入密码解锁，签名后重新锁定
+// selection 指定选币策略和手动选择的 UTXO，为空时使用默认策略
+// timeLock 指定锁定时间和相对锁定时间，为空时不锁定
+func NewTransaction(from, to string, amount int64, fee int64, selection *CoinSelection, timeLock *TimeLock, blockChain *BlockChain) *Transaction {
     wallets := NewWallets()
+    if !wallets.UnlockWithPrompt() {
+        return nil
+    }
+    defer wallets.Lock()
+    return newTransaction(wallets, from, to, amount, fee, selection, timeLock, blockChain)
+}
+
+// 使用已经解锁的钱包创建交易
+func newTransaction(wallets *Wallets, from, to string, amount int64, fee int64, selection *CoinSelection, timeLock *TimeLock, blockChain *BlockChain) *Transaction {
+    // 找出公钥和私钥
     walletMap := wallets.WalletMap
     walletKeyPair := walletMap[from]
-    if walletKeyPair == nil {
+    // 多重签名地址没有自己的私钥，使用钱包中属于该地址的私钥签名
+    multiSig := wallets.MultiSig[from]
+    if wallets.IsWatchOnly(from) {
+        fmt.Println("付款人地址为只读地址，钱包中没有私钥，交易失败!")
+        return nil
+    }
+    if walletKeyPair == nil && multiSig == nil {
         fmt.Println("付款人地址错误，交易失败!")
         return nil
     }
-    privateKey := walletKeyPair.PrivateKey
-    publicKey := walletKeyPair.PublicKey
 
+    tx := newUnsignedTransaction(wallets, from, to, amount, fee, selection, timeLock, blockChain)
+    if tx == nil {
+        return nil
+    }
+
+    if multiSig != nil {
+        // 签名不足时为部分签名的交易，需要其他持有人添加签名
+        fmt.Printf("对交易进行签名...\n")
+        _, err := wallets.SignMultiSig(tx)
+        if err != nil {
+            fmt.Printf("%v，交易失败!\n", err)
+            return nil
+        }
+        return tx
+    }
+    blockChain.SignTransaction(tx, walletKeyPair.PrivateKey)
+
+    return tx
+}
+
+// 创建未签名的交易，不需要私钥，付款人可以是只读地址
+// 付款人为钱包中的多重签名地址时，input 的解锁脚本为没有签名的模板
+func NewUnsignedTransaction(from, to string, amount int64, fee int64, selection *CoinSelection, timeLock *TimeLock, blockChain *BlockChain) *Transaction {
+    return newUnsignedTransaction(NewWallets(), from, to, amount, fee, selection, timeLock, blockChain)
+}
+
+// 按照手续费率创建未签名的交易
+func NewUnsignedTransactionWithFeeRate(from, to string, amount int64, feeRate int64, selection *CoinSelection, timeLock *TimeLock, blockChain *BlockChain) *Transaction {
+    wallets := NewWallets()
+    return withFeeRate(feeRate, func(fee int64) *Transaction {
+        return newUnsignedTransaction(wallets, from, to, amount, fee, selection, timeLock, blockChain)
+    })
+}
+
+func newUnsignedTransaction(wallets *Wallets, from, to string, amount int64, fee int64, selection *CoinSelection, timeLock *TimeLock, blockChain *BlockChain) *Transaction {
+    // 能用的 UTXO
+    UTXOs := make(map[string][]int)
+    // UTXO 存储的金额
+    var resValue int64
+
+    if amount <= 0 || !IsValidAmount(amount) {
+        fmt.Println("转账金额无效，交易失败!")
+        return nil
+    }
+    // 需要的总金额
+    total, err := AddAmount(amount, fee)
+    if err != nil {
+        fmt.Printf("手续费无效，交易失败: %v\n", err)
+        return nil
+    }
+
+    multiSig := wallets.MultiSig[from]
     publicKeyHash := Lock(from)
+    if timeLock == nil {
+        timeLock = &TimeLock{Sequence: MaxSequence}
+    }
 
-    UTXOs, resValue = blockChain.FindNeedUTXOs(publicKeyHash, amount)
+    UTXOs, resValue, err = blockChain.FindNeedUTXOs(publicKeyHash, total, selection)
+    if err != nil {
+        fmt.Printf("%v，交易失败!\n", err)
+        return nil
+    }
 
     // 金额不足以转账，创建交易失败
-    if resValue < amount {
+    if resValue < total {
         fmt.Println("余额不足，交易失败!")
         return nil
     }
@@ -137,143 +396,198 @@ func NewTransaction(from, to string, amount float64, blockChain *BlockChain) *Tr
     // UTXOs: 0x111 => {0, 1}
     for txId, indexes := range UTXOs {
         for _, index := range indexes {
-            inputs = append(inputs, TxInput{[]byte(txId), index, nil, publicKey})
+            input := TxInput{TxId: []byte(txId), Index: index, Sequence: timeLock.Sequence}
+            if multiSig != nil {
+                input.ScriptSig = multiSigScriptSig(multiSig.RedeemScript)
+            }
+            inputs = append(inputs, input)
         }
     }
     var outputs []TxOutput
     // 创建属于收款人的 output
-    output := TxOutput{amount, Lock(to)}
+    output := TxOutput{Value: amount, ScriptPubKey: LockScript(to)}
     outputs = append(outputs, output)
 
-    if resValue > amount {
+    if resValue > total {
         // 如果有找零，创建属于付款人的 output
-        outputs = append(outputs, TxOutput{resValue - amount, Lock(from)})
+        outputs = append(outputs, TxOutput{Value: resValue - total, ScriptPubKey: LockScript(from)})
     }
 
-    tx := &Transaction{nil, inputs, outputs}
+    tx := &Transaction{TxInputs: inputs, TxOutputs: outputs, Version: TxVersion, LockTime: timeLock.LockTime}
     // 设置交易 id
     tx.SetTxID()
 
-    blockChain.SignTransaction(tx, privateKey)
-
     return tx
 }
 
+// 按照手续费率创建交易
+// feeRate 为每字节的手续费（聪），手续费随交易大小变化，重复创建直到手续费足够
+func NewTransactionWithFeeRate(from, to string, amount int64, feeRate int64, selection *CoinSelection, timeLock *TimeLock, blockChain *BlockChain) *Transaction {
+    // 只解锁一次钱包
+    wallets := NewWallets()
+    if !wallets.UnlockWithPrompt() {
+        return nil
+    }
+    defer wallets.Lock()
+
+    return withFeeRate(feeRate, func(fee int64) *Transaction {
+        return newTransaction(wallets, from, to, amount, fee, selection, timeLock, blockChain)
+    })
+}
+
+// 按照手续费率重复创建交易，直到手续费足够
+func withFeeRate(feeRate int64, create func(fee int64) *Transaction) *Transaction {
+    var fee int64
+    for i := 0; i < 5; i++ {
+        tx := create(fee)
+        if tx == nil {
+            return nil
+        }
+        needFee := feeRate * tx.EstimatedSize()
+        if needFee <= fee {
+            return tx
+        }
+        fee = needFee
+    }
+    fmt.Println("无法确定手续费，交易失败!")
+    return nil
+}
+
 // 签名
-func (tx *Transaction) Sign(privateKey *ecdsa.PrivateKey, txs map[string]*Transaction) {
+// 对锁定脚本为该私钥的 P2PKH 的 input 签名，解锁脚本为 <签名> <公钥>
+// 其他 input 不变，可以由其他私钥签名
+func (tx *Transaction) Sign(privateKey *secp256k1.PrivateKey, txs map[string]*Transaction) {
     fmt.Printf("签名...\n")
-    // 复制交易
-    copyTx := tx.Copy()
-    // 遍历复制出来的 inputs 找到所引用的交易
-    for i := 0; i < len(copyTx.TxInputs); i++ {
-        input := copyTx.TxInputs[i]
+    for i, input := range tx.TxInputs {
         prevTx := txs[string(input.TxId)]
-        // 将 PublicKeyHash 赋值给 PublicKey
-        copyTx.TxInputs[i].PublicKey = prevTx.TxOutputs[input.Index].PublicKeyHash
-        // 对交易进行 hash 运算，求出交易的 hash
-        copyTx.SetTxID()
-        signData := copyTx.TxId
+        // 找不到引用的交易
+        if prevTx == nil || input.Index < 0 || input.Index >= len(prevTx.TxOutputs) {
+            fmt.Printf("未找到 input 引用的交易 %x\n", input.TxId)
+            return
+        }
+        tx.signInput(i, privateKey, &prevTx.TxOutputs[input.Index])
+    }
+}
 
-        fmt.Printf("对数据 %x 进行签名\n", signData)
+// 使用私钥为 input 签名，prevOutput 为 input 引用的 output
+// 锁定脚本不是该私钥的 P2PKH 或 input 已经签名时返回 false
+func (tx *Transaction) signInput(index int, privateKey *secp256k1.PrivateKey, prevOutput *TxOutput) bool {
+    if tx.TxInputs[index].ScriptSig != nil {
+        return false
+    }
+    compressed := privateKey.PubKey().SerializeCompressed()
+    uncompressed := privateKey.PubKey().SerializeUncompressed()
+    lockScript := prevOutput.LockScript()
+    var publicKey []byte
+    switch publicKeyHash := extractPublicKeyHash(lockScript) ; {
+        case bytes.Equal(publicKeyHash, HashPublicKey(compressed)):
+            publicKey = compressed
+        case bytes.Equal(publicKeyHash, HashPublicKey(uncompressed)):
+            publicKey = uncompressed
+        default:
+            return false
+    }
+    signData := tx.SigHash(index, lockScript)
 
-        // 将当前签完名的 PublicKey 设置为 nil
-        input.PublicKey = nil
+    fmt.Printf("对数据 %x 进行签名\n", signData)
 
-        // 对交易 hash 进行签名
-        r, s, err := ecdsa.Sign(rand.Reader, privateKey, signData)
-        if err != nil {
-            fmt.Printf("对交易进行签名失败, err: %v\n", err)
-        }
-        // 拼接 r s
-        signature := append(r.Bytes(), s.Bytes()...)
-        // 赋值给原始交易的 Signature 字段
-        tx.TxInputs[i].Signature = signature
-    }
+    // 对签名数据进行签名，使用 DER 编码，末尾加上签名类型
+    signature := append(ecdsa.Sign(privateKey, signData).Serialize(), SigHashAll)
+    tx.TxInputs[index].ScriptSig = pushData(pushData(nil, signature), publicKey)
+    return true
 }
 
 // 校验签名
+// 依次执行每个 input 的解锁脚本和引用的 output 的锁定脚本
+// 旧版本的交易只存在于迁移金额之前的区块中，签名使用 P256 密钥和 float64 金额计算，无法校验
 func (tx *Transaction) Verify(txs map[string]*Transaction) bool {
     fmt.Printf("校验...\n")
-    // 复制交易
-    copyTx := tx.Copy()
-    // 遍历 inputs 找到所引用的交易
-    for i := 0; i < len(tx.TxInputs); i++ {
-        input := tx.TxInputs[i]
+    err := tx.checkFormat()
+    if err != nil {
+        fmt.Printf("%v\n", err)
+        return false
+    }
+    if tx.Version == LegacyTxVersion {
+        fmt.Printf("旧版本的交易无法校验签名\n")
+        return false
+    }
+    for i, input := range tx.TxInputs {
         prevTx := txs[string(input.TxId)]
-        // 将 PublicKeyHash 赋值给 PublicKey
-        copyTx.TxInputs[i].PublicKey = prevTx.TxOutputs[input.Index].PublicKeyHash
-        // 对交易进行 hash 运算，求出交易的 hash
-        copyTx.SetTxID()
-        // 这里的 verifyData 就是需要校验的数据
-        verifyData := copyTx.TxId
-
-        fmt.Printf("对数据 %x 进行校验\n", verifyData)
-
-        // 将当前签完名的 PublicKey 设置为 nil
-        copyTx.TxInputs[i].PublicKey = nil
-
-        // 获取 signature
-        signature := input.Signature
-        // 裁切成签名后的 r 和 s
-        var r big.Int
-        var s big.Int
-        r.SetBytes(signature[:len(signature) / 2])
-        s.SetBytes(signature[len(signature) / 2:])
-
-        // 获取使用了 gob 编码后的 publicKey
-        pubKey := input.PublicKey
-        // 反序列化成 PublicKey
-        var publicKey *ecdsa.PublicKey
-        gob.Register(elliptic.P256())
-        decoder := gob.NewDecoder(bytes.NewReader(pubKey))
-        err := decoder.Decode(&publicKey)
-        if err != nil {
-            fmt.Printf("反序列化 PublickKey 错误: %v\n", err)
+        // 找不到引用的交易
+        if prevTx == nil || input.Index < 0 || input.Index >= len(prevTx.TxOutputs) {
+            fmt.Printf("未找到 input 引用的交易 %x\n", input.TxId)
+            return false
         }
-        // 校验
-        if !ecdsa.Verify(publicKey, verifyData, &r, &s) {
+        prevOutput := prevTx.TxOutputs[input.Index]
+        err := VerifyScript(tx, i, &prevOutput)
+        if err != nil {
             // 只要有一输入交易校验未通过就返回
+            fmt.Printf("input %d 脚本校验失败: %v\n", i, err)
             return false
         }
-
     }
     return true
 }
 
 // 复制交易
-// 将每个输入交易 Signature 和 PublicKey 设置为 nil
+// 将每个输入交易 Signature、PublicKey 和 ScriptSig 设置为 nil
 // 输出交易不变
 func (tx *Transaction) Copy() Transaction {
     var inputs []TxInput
     var outputs []TxOutput
 
     for _, input := range tx.TxInputs {
-        txInput := TxInput{input.TxId, input.Index, nil, nil}
+        txInput := TxInput{TxId: input.TxId, Index: input.Index, Sequence: input.Sequence}
         inputs = append(inputs, txInput)
     }
 
     outputs = tx.TxOutputs
 
-    return Transaction{tx.TxId, inputs, outputs}
+    return Transaction{TxId: tx.TxId, TxInputs: inputs, TxOutputs: outputs, Version: tx.Version, LockTime: tx.LockTime}
 }
 
 // 定义 String 方法
 func (tx *Transaction) String() string {
     var lines []string
     lines = append(lines, fmt.Sprintf("\n  Transaction %x:", tx.TxId))
+    lines = append(lines, fmt.Sprintf("    Version: %d", tx.Version))
+    if tx.LockTime != 0 {
+        lines = append(lines, fmt.Sprintf("    LockTime: %d (%s)", tx.LockTime, FormatLockTime(tx.LockTime)))
+    }
 
     for i, txInput := range tx.TxInputs {
         lines = append(lines, fmt.Sprintf("    Input %d:", i))
         lines = append(lines, fmt.Sprintf("      TxId: %x", txInput.TxId))
         lines = append(lines, fmt.Sprintf("      OutIndex: %d", txInput.Index))
-        lines = append(lines, fmt.Sprintf("      Signature: %x", txInput.Signature))
-        lines = append(lines, fmt.Sprintf("      PublicKey: %x", txInput.PublicKey))
+        switch {
+            case tx.Version == LegacyTxVersion:
+                lines = append(lines, fmt.Sprintf("      Signature: %x", txInput.Signature))
+                lines = append(lines, fmt.Sprintf("      PublicKey: %x", txInput.PublicKey))
+            case tx.IsCoinBase():
+                lines = append(lines, fmt.Sprintf("      ScriptSig: %x", txInput.ScriptSig))
+            default:
+                lines = append(lines, fmt.Sprintf("      ScriptSig: %s", DisassembleScript(txInput.ScriptSig)))
+        }
+        if tx.Version >= TxVersion && !tx.IsCoinBase() {
+            if relative := formatSequence(txInput.Sequence) ; relative != "" {
+                lines = append(lines, fmt.Sprintf("      Sequence: %#x (相对锁定 %s)", txInput.Sequence, relative))
+            } else {
+                lines = append(lines, fmt.Sprintf("      Sequence: %#x", txInput.Sequence))
+            }
+        }
     }
 
     for i, txOutput := range tx.TxOutputs {
         lines = append(lines, fmt.Sprintf("    Output %d:", i))
-        lines = append(lines, fmt.Sprintf("      Value: %f", txOutput.Value))
-        lines = append(lines, fmt.Sprintf("      PublicKeyHash: %x", txOutput.PublicKeyHash))
+        lines = append(lines, fmt.Sprintf("      Value: %s", FormatAmount(txOutput.Value)))
+        if tx.Version == LegacyTxVersion {
+            lines = append(lines, fmt.Sprintf("      PublicKeyHash: %x", txOutput.PublicKeyHash))
+        } else {
+            lines = append(lines, fmt.Sprintf("      ScriptPubKey: %s", DisassembleScript(txOutput.ScriptPubKey)))
+        }
+        if address := txOutput.Address() ; address != "" {
+            lines = append(lines, fmt.Sprintf("      Address: %s", address))
+        }
     }
 
     return strings.Join(lines, "\n")
@@ -0,0 +1,247 @@
+package block
+
+import (
+    "bytes"
+    "encoding/gob"
+    "fmt"
+    "github.com/boltdb/bolt"
+    "log"
+)
+
+// UTXO 集合使用的 Bucket
+// key 为交易 id，value 为该交易中所有未花费的 output
+const UTXOBucketName = "utxo_bucket"
+
+// UTXO 集合的版本，保存在区块的 Bucket 中
+// 版本 1 的 UTXO 记录了所在的区块高度和是否为挖矿交易的 output，旧版本的 UTXO 集合需要重建
+const UTXOVersionKey = "utxo_version"
+const UTXOVersion = "1"
+
+// 挖矿交易的 output 需要经过多少个区块才能花费
+// 发生链重组时挖矿交易可能失效，花费它的交易也随之失效
+const CoinBaseMaturity = 100
+
+// 开始检查挖矿交易成熟度之前的最后一个区块 hash
+// 旧版本的区块链可能在成熟之前花费了挖矿奖励，校验时跳过这个区块及之前的区块
+const MaturityHashKey = "maturity_block_hash"
+
+// 判断 UTXO 能否在高度为 height 的区块中花费
+func (info *UTXOInfo) IsMature(height uint64) bool {
+    return !info.CoinBase || height >= info.Height+CoinBaseMaturity
+}
+
+// 判断是否需要重建 UTXO 集合
+// 旧版本的数据库没有 UTXO 集合，或者 UTXO 集合没有区块高度
+func needReindexUTXO(tx *bolt.Tx) bool {
+    if tx.Bucket([]byte(UTXOBucketName)) == nil {
+        return true
+    }
+    return string(tx.Bucket([]byte(BucketName)).Get([]byte(UTXOVersionKey))) != UTXOVersion
+}
+
+// 将 UTXO 序列化
+func utxosToBytes(UTXOInfos []UTXOInfo) []byte {
+    var buffer bytes.Buffer
+    encoder := gob.NewEncoder(&buffer)
+    err := encoder.Encode(UTXOInfos)
+    if err != nil {
+        log.Panic(err)
+    }
+    return buffer.Bytes()
+}
+
+// 将 UTXO 反序列化
+func bytesToUTXOs(data []byte) []UTXOInfo {
+    var UTXOInfos []UTXOInfo
+    decoder := gob.NewDecoder(bytes.NewReader(data))
+    err := decoder.Decode(&UTXOInfos)
+    if err != nil {
+        log.Panic(err)
+    }
+    return UTXOInfos
+}
+
+// 使用区块中的交易更新 UTXO 集合
+// 1.删除 input 引用的 output
+// 2.添加交易中新产生的 output
+func updateUTXOSet(bucket *bolt.Bucket, block *Block) error {
+    for _, tx := range block.Transactions {
+        // 挖矿交易没有引用 output
+        if !tx.IsCoinBase() {
+            for _, input := range tx.TxInputs {
+                value := bucket.Get(input.TxId)
+                if value == nil {
+                    continue
+                }
+                var UTXOInfos []UTXOInfo
+                for _, UTXOInfo := range bytesToUTXOs(value) {
+                    if UTXOInfo.Index != input.Index {
+                        UTXOInfos = append(UTXOInfos, UTXOInfo)
+                    }
+                }
+                var err error
+                if len(UTXOInfos) == 0 {
+                    // 交易中的 output 已全部花费
+                    err = bucket.Delete(input.TxId)
+                } else {
+                    err = bucket.Put(input.TxId, utxosToBytes(UTXOInfos))
+                }
+                if err != nil {
+                    return err
+                }
+            }
+        }
+
+        var UTXOInfos []UTXOInfo
+        for i, output := range tx.TxOutputs {
+            UTXOInfos = append(UTXOInfos, UTXOInfo{tx.TxId, i, output, block.Height, tx.IsCoinBase()})
+        }
+        if len(UTXOInfos) == 0 {
+            continue
+        }
+        err := bucket.Put(tx.TxId, utxosToBytes(UTXOInfos))
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// 遍历整个账本，找出所有的 UTXO
+// txId => UTXO
+func (blockChain *BlockChain) FindAllUTXOs() map[string][]UTXOInfo {
+    UTXOs := make(map[string][]UTXOInfo)
+    // 0x111 => {0, 1}
+    spentUTXOs := make(map[string][]int)
+    it := blockChain.Iterator()
+    // 从最后一个区块开始遍历，花费 output 的 input 总是先于 output 被找到
+    for block := it.Next() ; block != nil ; block = it.Next() {
+        for _, tx := range block.Transactions {
+            if !tx.IsCoinBase() {
+                for _, input := range tx.TxInputs {
+                    key := string(input.TxId)
+                    spentUTXOs[key] = append(spentUTXOs[key], input.Index)
+                }
+            }
+
+        OUTPUT:
+            for i, output := range tx.TxOutputs {
+                key := string(tx.TxId)
+                for _, j := range spentUTXOs[key] {
+                    if j == i {
+                        continue OUTPUT
+                    }
+                }
+                UTXOs[key] = append(UTXOs[key], UTXOInfo{tx.TxId, i, output, block.Height, tx.IsCoinBase()})
+            }
+        }
+    }
+    return UTXOs
+}
+
+// 重建 UTXO 集合
+// 从旧版本的 UTXO 集合升级时，记录最后一个区块，之前的区块不检查挖矿交易的成熟度
+func (blockChain *BlockChain) ReindexUTXO() {
+    UTXOs := blockChain.FindAllUTXOs()
+
+    err := blockChain.boltDB.Update(func(tx *bolt.Tx) error {
+        bucketName := []byte(UTXOBucketName)
+        // 删除旧的 UTXO 集合
+        if tx.Bucket(bucketName) != nil {
+            err := tx.DeleteBucket(bucketName)
+            if err != nil {
+                return err
+            }
+        }
+        bucket, err := tx.CreateBucket(bucketName)
+        if err != nil {
+            return err
+        }
+        for txId, UTXOInfos := range UTXOs {
+            err = bucket.Put([]byte(txId), utxosToBytes(UTXOInfos))
+            if err != nil {
+                return err
+            }
+        }
+
+        blockBucket := tx.Bucket([]byte(BucketName))
+        if string(blockBucket.Get([]byte(UTXOVersionKey))) != UTXOVersion && blockChain.lastBlockHash != nil {
+            err = blockBucket.Put([]byte(MaturityHashKey), blockChain.lastBlockHash)
+            if err != nil {
+                return err
+            }
+        }
+        return blockBucket.Put([]byte(UTXOVersionKey), []byte(UTXOVersion))
+    })
+    if err != nil {
+        log.Panic(err)
+    }
+}
+
+// 统计 UTXO 集合中的交易数
+func (blockChain *BlockChain) CountUTXOTransactions() int {
+    var count int
+    blockChain.view(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket([]byte(UTXOBucketName))
+        count = bucket.Stats().KeyN
+        return nil
+    })
+    return count
+}
+
+// 检查交易引用的挖矿交易 output 在高度为 height 的区块中是否已经成熟
+func (blockChain *BlockChain) CheckMaturity(tx *Transaction, height uint64) error {
+    if tx.IsCoinBase() {
+        return nil
+    }
+    for _, input := range tx.TxInputs {
+        prevTx, block := blockChain.GetTransaction(input.TxId)
+        if prevTx == nil || !prevTx.IsCoinBase() {
+            continue
+        }
+        if height < block.Height+CoinBaseMaturity {
+            return fmt.Errorf("挖矿交易 %x 在区块 %d 中, 需要在区块 %d 之后才能花费", input.TxId, block.Height, block.Height+CoinBaseMaturity-1)
+        }
+    }
+    return nil
+}
+
+// 获取交易 txId 中第 index 个 output，output 已被花费时返回 false
+func (blockChain *BlockChain) GetUTXO(txId []byte, index int) (TxOutput, bool) {
+    var output TxOutput
+    var found bool
+    blockChain.view(func(tx *bolt.Tx) error {
+        value := tx.Bucket([]byte(UTXOBucketName)).Get(txId)
+        if value == nil {
+            return nil
+        }
+        for _, UTXOInfo := range bytesToUTXOs(value) {
+            if UTXOInfo.Index == index {
+                output = UTXOInfo.Output
+                found = true
+            }
+        }
+        return nil
+    })
+    return output, found
+}
+
+// 查找 UTXO
+// 直接从 UTXO 集合中读取，不再遍历整个账本
+func (blockChain *BlockChain) FindMyUTXOs(publicKeyHash []byte) []UTXOInfo {
+    var UTXOInfos []UTXOInfo
+    blockChain.view(func(tx *bolt.Tx) error {
+        bucket := tx.Bucket([]byte(UTXOBucketName))
+        return bucket.ForEach(func(key, value []byte) error {
+            for _, UTXOInfo := range bytesToUTXOs(value) {
+                // 查找属于 address 的 output
+                if bytes.Equal(UTXOInfo.Output.LockedHash(), publicKeyHash) {
+                    UTXOInfos = append(UTXOInfos, UTXOInfo)
+                }
+            }
+            return nil
+        })
+    })
+    return UTXOInfos
+}
+
@@ -0,0 +1,220 @@
+package block
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "fmt"
+    "github.com/boltdb/bolt"
+    "math/big"
+)
+
+// 区块校验错误
+type ValidationError struct {
+    Height int    // 区块高度
+    Hash   []byte // 区块 hash
+    Reason string // 失败原因
+}
+
+func (err *ValidationError) Error() string {
+    return fmt.Sprintf("区块 %d (%x) 校验失败: %s", err.Height, err.Hash, err.Reason)
+}
+
+// 重新计算区块头 hash
+func (block *Block) CalculateHash() []byte {
+    hash := sha256.Sum256(toBytes(block, block.Nonce))
+    return hash[:]
+}
+
+// 重新计算交易 id
+// 交易 id 在签名之前计算，不包括签名
+// 旧版本（版本号为 0）的交易 id 是对 float64 金额的 gob 编码计算的，无法重新计算
+func (tx *Transaction) CalculateTxID() []byte {
+    hash := sha256.Sum256(tx.serialize(-1, nil))
+    return hash[:]
+}
+
+// 旧版本的梅特尔根，将交易 id 拼接后做一次 hash 运算
+func legacyMerkleRoot(block *Block) []byte {
+    var txIds []byte
+    for _, tx := range block.Transactions {
+        txIds = append(txIds, tx.TxId...)
+    }
+    hash := sha256.Sum256(txIds)
+    return hash[:]
+}
+
+// 校验整条区块链
+// 从创世块开始，依次校验
+// 1.区块头 hash
+// 2.与前一个区块的连接以及区块高度
+// 3.工作量证明、难度值和累计工作量
+// 4.梅特尔根
+// 5.挖矿交易规则
+// 6.交易 id、交易格式、锁定时间和脚本
+// 7.没有双花，挖矿交易的 output 成熟后才能花费
+// 8.输入金额不小于输出金额
+// 返回第一个校验失败的区块
+func (blockChain *BlockChain) Validate() error {
+    // 按照从创世块到最后一个区块的顺序
+    var blocks []*Block
+    it := blockChain.Iterator()
+    for block := it.Next() ; block != nil ; block = it.Next() {
+        blocks = append([]*Block{block}, blocks...)
+    }
+
+    // 校验过程中的 UTXO，与数据库中的 UTXO 集合相互独立
+    UTXOs := make(map[string]TxOutput)
+    // 已校验的交易
+    txs := make(map[string]*Transaction)
+    // 交易所在的区块，用于检查相对锁定时间
+    txBlocks := make(map[string]*Block)
+
+    // 迁移金额之前的区块，交易 id 和签名是对 float64 金额计算的，无法重新计算，梅特尔根也使用旧的算法
+    var legacyHash []byte
+    blockChain.view(func(tx *bolt.Tx) error {
+        legacyHash = copyBytes(tx.Bucket([]byte(BucketName)).Get([]byte(LegacyHashKey)))
+        return nil
+    })
+    legacy := legacyHash != nil
+
+    // 升级 UTXO 集合之前的区块不检查挖矿交易的成熟度
+    var maturityHash []byte
+    blockChain.view(func(tx *bolt.Tx) error {
+        maturityHash = copyBytes(tx.Bucket([]byte(BucketName)).Get([]byte(MaturityHashKey)))
+        return nil
+    })
+    checkMaturity := maturityHash == nil
+
+    prevHash := []byte{0x0000000000000000}
+    // 累计工作量
+    chainWork := big.NewInt(0)
+    for height, block := range blocks {
+        fail := func(format string, a ...interface{}) error {
+            return &ValidationError{height, block.Hash, fmt.Sprintf(format, a...)}
+        }
+
+        if !bytes.Equal(block.CalculateHash(), block.Hash) {
+            return fail("区块头 hash 不正确, 计算结果为 %x", block.CalculateHash())
+        }
+        if !bytes.Equal(block.PrevHash, prevHash) {
+            return fail("前一个区块 hash 为 %x, 期望为 %x", block.PrevHash, prevHash)
+        }
+        if block.Height != uint64(height) {
+            return fail("区块高度为 %d, 期望为 %d", block.Height, height)
+        }
+        if indexed := blockChain.GetBlockByHeight(uint64(height)); indexed == nil || !bytes.Equal(indexed.Hash, block.Hash) {
+            return fail("区块高度索引不正确")
+        }
+        difficulty := blockChain.NextDifficulty(block.PrevHash)
+        if !SameDifficulty(block.Difficulty, difficulty) {
+            return fail("难度值为 %#x, 期望为 %#x", block.Difficulty, difficulty)
+        }
+        if !NewProofOfWork(block).IsValid(difficulty) {
+            return fail("工作量证明无效")
+        }
+        chainWork.Add(chainWork, BlockWork(block.Difficulty))
+        if block.ChainWork == nil || block.ChainWork.Cmp(chainWork) != 0 {
+            return fail("累计工作量为 %v, 期望为 %v", block.ChainWork, chainWork)
+        }
+        merkleRoot := block.MerkleTree().Root()
+        if legacy {
+            merkleRoot = legacyMerkleRoot(block)
+        }
+        if !bytes.Equal(block.MerKleRoot, merkleRoot) {
+            return fail("梅特尔根为 %x, 计算结果为 %x", block.MerKleRoot, merkleRoot)
+        }
+
+        if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinBase() {
+            return fail("第一笔交易不是挖矿交易")
+        }
+
+        // 挖矿交易的金额和区块中所有交易的手续费
+        var coinBaseValue int64
+        var fees int64
+
+        for i, tx := range block.Transactions {
+            if !legacy && tx.Version == LegacyTxVersion {
+                return fail("交易 %x 是旧版本的交易, 只能出现在迁移金额之前的区块中", tx.TxId)
+            }
+            if !legacy && !bytes.Equal(tx.CalculateTxID(), tx.TxId) {
+                return fail("交易 %x 的 id 与内容不一致", tx.TxId)
+            }
+            if err := tx.checkFormat(); err != nil {
+                return fail("交易 %x 格式错误: %v", tx.TxId, err)
+            }
+            if _, ok := txs[string(tx.TxId)]; ok {
+                return fail("交易 %x 重复", tx.TxId)
+            }
+
+            if tx.IsCoinBase() {
+                if i != 0 {
+                    return fail("交易 %x 是多余的挖矿交易", tx.TxId)
+                }
+                var err error
+                coinBaseValue, err = tx.OutputValue()
+                if err != nil {
+                    return fail("挖矿交易 %x 的金额无效: %v", tx.TxId, err)
+                }
+            } else {
+                var inputValue int64
+                prevTxs := make(map[string]*Transaction)
+                prevBlocks := make(map[string]*Block)
+                for _, input := range tx.TxInputs {
+                    key := outPointKey(input.TxId, input.Index)
+                    output, ok := UTXOs[key]
+                    if !ok {
+                        return fail("交易 %x 引用的 output %s 不存在或已被花费", tx.TxId, key)
+                    }
+                    // 同一个区块中后面的交易不能再次引用
+                    delete(UTXOs, key)
+                    if prevTx, prevBlock := txs[string(input.TxId)], txBlocks[string(input.TxId)]; checkMaturity && prevTx.IsCoinBase() && block.Height < prevBlock.Height+CoinBaseMaturity {
+                        return fail("交易 %x 花费了区块 %d 中未成熟的挖矿交易 %x", tx.TxId, prevBlock.Height, input.TxId)
+                    }
+                    var err error
+                    inputValue, err = AddAmount(inputValue, output.Value)
+                    if err != nil {
+                        return fail("交易 %x 的输入金额无效: %v", tx.TxId, err)
+                    }
+                    prevTxs[string(input.TxId)] = txs[string(input.TxId)]
+                    prevBlocks[string(input.TxId)] = txBlocks[string(input.TxId)]
+                }
+                if err := tx.CheckLockTime(block.Height, block.Timestamp, prevBlocks); err != nil {
+                    return fail("交易 %x 无效: %v", tx.TxId, err)
+                }
+                outputValue, err := tx.OutputValue()
+                if err != nil {
+                    return fail("交易 %x 的输出金额无效: %v", tx.TxId, err)
+                }
+                if inputValue < outputValue {
+                    return fail("交易 %x 的输出金额 %s 大于输入金额 %s", tx.TxId, FormatAmount(outputValue), FormatAmount(inputValue))
+                }
+                fees, err = AddAmount(fees, inputValue-outputValue)
+                if err != nil {
+                    return fail("区块的手续费无效: %v", err)
+                }
+                if !legacy && !tx.Verify(prevTxs) {
+                    return fail("交易 %x 签名校验失败", tx.TxId)
+                }
+            }
+
+            txs[string(tx.TxId)] = tx
+            txBlocks[string(tx.TxId)] = block
+            for j, output := range tx.TxOutputs {
+                UTXOs[outPointKey(tx.TxId, j)] = output
+            }
+        }
+
+        if subsidy := BlockSubsidy(blockChain.params, height); coinBaseValue > subsidy+fees {
+            return fail("挖矿交易的金额 %s 超过挖矿奖励 %s 和手续费 %s", FormatAmount(coinBaseValue), FormatAmount(subsidy), FormatAmount(fees))
+        }
+
+        prevHash = block.Hash
+        if bytes.Equal(block.Hash, legacyHash) {
+            legacy = false
+        }
+        if bytes.Equal(block.Hash, maturityHash) {
+            checkMaturity = true
+        }
+    }
+    return nil
+}
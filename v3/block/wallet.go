@@ -2,20 +2,46 @@ package block
 
 import (
     "bytes"
-    "crypto/elliptic"
     "crypto/sha256"
     "encoding/gob"
     "fmt"
     "github.com/btcsuite/btcutil/base58"
     "io/ioutil"
+    "log"
     "os"
+    "strings"
 )
 
 const WalletFilename = "wallet.dat"
 
+// 获取钱包文件路径
+// 设置了节点 id 时，使用 wallet_<id>.dat
+func walletPath() string {
+    nodeId := GetNodeId()
+    if nodeId == "" {
+        return WalletFilename
+    }
+    return strings.TrimSuffix(WalletFilename, ".dat") + "_" + nodeId + ".dat"
+}
+
 // 定义钱包结构
 type Wallets struct {
-    WalletMap map[string]*WalletKeyPair
+    WalletMap  map[string]*WalletKeyPair
+    WatchOnly  map[string]*WatchOnlyAddress // 只读地址
+    MultiSig   map[string]*MultiSigAddress  // 多重签名地址
+    encryption *WalletEncryption // 加密后的私钥，没有加密时为 nil
+    key        []byte            // 解锁后的密钥，锁定时为 nil
+    hdChain    *HDChain          // 助记词和派生状态，没有助记词时为 nil
+}
+
+// 钱包文件的结构
+// 没有加密时 WalletMap 中保存私钥，加密后 WalletMap 中只保存公钥，私钥和助记词保存在 Encryption 中
+type walletFile struct {
+    WalletMap  map[string]*WalletKeyPair
+    WatchOnly  map[string]*WatchOnlyAddress
+    MultiSig   map[string]*MultiSigAddress
+    Encryption *WalletEncryption
+    HDChain    *HDChain
 }
 
 // 创建钱包
@@ -24,19 +50,33 @@ func NewWallets() *Wallets {
     // 从文件中加载数据
     wallets, err := loadFromFile()
     if err != nil {
-        panic(err)
+        log.Fatal(err)
     }
     return wallets
 }
 
+// 创建钱包地址，从助记词派生下一个地址
+// 钱包没有助记词时先生成助记词
 func (wallets *Wallets) CreateWallet() string {
-    walletKeyPair := NewWalletKeyPair()
-    address := walletKeyPair.GetAddress()
-
-    wallets.WalletMap[address] = walletKeyPair
+    if wallets.IsLocked() {
+        fmt.Println("钱包已加密, 请先解锁!")
+        return ""
+    }
+    if !wallets.HasHDChain() {
+        _, err := wallets.NewHDChain()
+        if err != nil {
+            fmt.Printf("生成助记词失败: %v\n", err)
+            return ""
+        }
+    }
+    address, err := wallets.nextHDAddress()
+    if err != nil {
+        fmt.Printf("派生地址失败: %v\n", err)
+        return ""
+    }
 
     // 保存到文件
-    err := saveToFile(wallets)
+    err = saveToFile(wallets)
     if err != nil {
         return ""
     }
@@ -44,11 +84,151 @@ func (wallets *Wallets) CreateWallet() string {
     return address
 }
 
+// 钱包是否已加密
+func (wallets *Wallets) IsEncrypted() bool {
+    return wallets.encryption != nil
+}
+
+// 钱包是否处于锁定状态，锁定时无法使用私钥
+func (wallets *Wallets) IsLocked() bool {
+    return wallets.IsEncrypted() && wallets.key == nil
+}
+
+// 使用密码加密钱包，加密后钱包处于锁定状态
+func (wallets *Wallets) Encrypt(passphrase string) error {
+    if wallets.IsEncrypted() {
+        return fmt.Errorf("钱包已加密")
+    }
+    return wallets.setPassphrase(passphrase)
+}
+
+// 修改钱包密码，修改后钱包处于锁定状态
+func (wallets *Wallets) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+    if !wallets.IsEncrypted() {
+        return fmt.Errorf("钱包没有加密")
+    }
+    err := wallets.Unlock(oldPassphrase)
+    if err != nil {
+        return err
+    }
+    return wallets.setPassphrase(newPassphrase)
+}
+
+// 使用新的盐和密码重新加密私钥并保存
+func (wallets *Wallets) setPassphrase(passphrase string) error {
+    if passphrase == "" {
+        return fmt.Errorf("密码不能为空")
+    }
+    encryption := newWalletEncryption()
+    key, err := encryption.deriveKey(passphrase)
+    if err != nil {
+        return err
+    }
+    wallets.encryption = encryption
+    wallets.key = key
+    err = saveToFile(wallets)
+    wallets.Lock()
+    return err
+}
+
+// 使用密码解锁钱包，将私钥解密到内存中
+// 只在当前命令中有效，钱包文件保持加密，之后保存时重新加密私钥
+func (wallets *Wallets) Unlock(passphrase string) error {
+    if !wallets.IsEncrypted() {
+        return nil
+    }
+    key, err := wallets.encryption.deriveKey(passphrase)
+    if err != nil {
+        return err
+    }
+    privateKeys, err := wallets.encryption.open(key)
+    if err != nil {
+        return err
+    }
+    for address, walletKeyPair := range wallets.WalletMap {
+        data, ok := privateKeys[address]
+        if !ok {
+            return fmt.Errorf("钱包 %s 缺少私钥", address)
+        }
+        walletKeyPair.PrivateKey = privateKeyFromBytes(data)
+    }
+    if wallets.HasHDChain() {
+        mnemonic, ok := privateKeys[hdMnemonicKey]
+        if !ok {
+            return fmt.Errorf("钱包缺少助记词")
+        }
+        wallets.hdChain.Mnemonic = string(mnemonic)
+    }
+    wallets.key = key
+    return nil
+}
+
+// 钱包锁定时读取密码并解锁，解锁失败时返回 false
+func (wallets *Wallets) UnlockWithPrompt() bool {
+    if !wallets.IsLocked() {
+        return true
+    }
+    err := wallets.Unlock(ReadPassphrase("请输入钱包密码: "))
+    if err != nil {
+        fmt.Printf("解锁钱包失败: %v\n", err)
+        return false
+    }
+    return true
+}
+
+// 永久解除钱包加密，私钥以明文写回钱包文件
+// 不是解锁，需要私钥的命令使用 Unlock 在内存中临时解密
+func (wallets *Wallets) DecryptFile(passphrase string) error {
+    if !wallets.IsEncrypted() {
+        return fmt.Errorf("钱包没有加密")
+    }
+    err := wallets.Unlock(passphrase)
+    if err != nil {
+        return err
+    }
+    wallets.encryption = nil
+    wallets.key = nil
+    return saveToFile(wallets)
+}
+
+// 锁定钱包，从内存中删除私钥和密钥
+func (wallets *Wallets) Lock() {
+    if !wallets.IsEncrypted() {
+        return
+    }
+    for _, walletKeyPair := range wallets.WalletMap {
+        if walletKeyPair.PrivateKey != nil {
+            walletKeyPair.PrivateKey.Zero()
+        }
+        walletKeyPair.PrivateKey = nil
+    }
+    if wallets.HasHDChain() {
+        wallets.hdChain.Mnemonic = ""
+    }
+    for i := range wallets.key {
+        wallets.key[i] = 0
+    }
+    wallets.key = nil
+}
+
+// 将密钥对加入钱包，地址原来是只读地址时不再只读
+func (wallets *Wallets) addKeyPair(address string, walletKeyPair *WalletKeyPair) {
+    wallets.WalletMap[address] = walletKeyPair
+    delete(wallets.WatchOnly, address)
+}
+
+// 获取所有地址，包括只读地址和多重签名地址
 func (wallets *Wallets) ListAddress() []string {
     var addresses []string
     for address, _ := range wallets.WalletMap {
         addresses = append(addresses, address)
     }
+    for address, _ := range wallets.WatchOnly {
+        addresses = append(addresses, address)
+    }
+    for address, _ := range wallets.MultiSig {
+        addresses = append(addresses, address)
+    }
     return addresses
 }
 
@@ -59,6 +239,11 @@ func IsValidAddress(address string) bool {
         fmt.Printf("地址长度不正确!\n")
         return false
     }
+    // 只支持公钥哈希地址和脚本哈希地址
+    if decodeInfo[0] != PublicKeyHashAddressVersion && decodeInfo[0] != ScriptHashAddressVersion {
+        fmt.Printf("地址版本号不正确!\n")
+        return false
+    }
     i := len(decodeInfo)-4
     // 21 个字节
     payload := decodeInfo[:i]
@@ -73,17 +258,43 @@ func IsValidAddress(address string) bool {
 }
 
 func saveToFile(wallets *Wallets) error {
+    file := walletFile{WalletMap: wallets.WalletMap, WatchOnly: wallets.WatchOnly, MultiSig: wallets.MultiSig, HDChain: wallets.hdChain}
+    if wallets.IsEncrypted() {
+        // 加密私钥和助记词，文件中只保存公钥
+        file.Encryption = wallets.encryption
+        file.WalletMap = make(map[string]*WalletKeyPair)
+        privateKeys := make(map[string][]byte)
+        for address, walletKeyPair := range wallets.WalletMap {
+            file.WalletMap[address] = &WalletKeyPair{PublicKey: walletKeyPair.PublicKey}
+            if walletKeyPair.PrivateKey != nil {
+                privateKeys[address] = privateKeyToBytes(walletKeyPair.PrivateKey)
+            }
+        }
+        if wallets.HasHDChain() {
+            chain := *wallets.hdChain
+            chain.Mnemonic = ""
+            file.HDChain = &chain
+            privateKeys[hdMnemonicKey] = []byte(wallets.hdChain.Mnemonic)
+        }
+        // 锁定时没有私钥，保留原来加密的内容
+        if !wallets.IsLocked() {
+            err := wallets.encryption.seal(wallets.key, privateKeys)
+            if err != nil {
+                fmt.Printf("Wallet 加密失败, err: %v\n", err)
+                return err
+            }
+        }
+    }
+
     var buffer bytes.Buffer
-    // 注册接口类型
-    gob.Register(elliptic.P256())
     encoder := gob.NewEncoder(&buffer)
-    err := encoder.Encode(wallets)
+    err := encoder.Encode(file)
     if err != nil {
         fmt.Printf("Wallet 序列化失败, err: %v\n", err)
         return err
     }
     content := buffer.Bytes()
-    err = ioutil.WriteFile(WalletFilename, content, 0600)
+    err = ioutil.WriteFile(walletPath(), content, 0600)
     if err != nil {
         fmt.Printf("Wallet 保存失败, err: %v\n", err)
         return err
@@ -91,25 +302,49 @@ func saveToFile(wallets *Wallets) error {
     return nil
 }
 
+// 加载钱包文件
+// 旧版本的钱包文件只有 WalletMap，解码后为没有加密的钱包
 func loadFromFile() (*Wallets, error) {
-    var wallets Wallets
-    _, err := os.Stat(WalletFilename)
+    _, err := os.Stat(walletPath())
     if os.IsNotExist(err) {
-        wallets = Wallets{make(map[string]*WalletKeyPair)}
-        return &wallets, nil
+        return &Wallets{
+            WalletMap: make(map[string]*WalletKeyPair),
+            WatchOnly: make(map[string]*WatchOnlyAddress),
+            MultiSig:  make(map[string]*MultiSigAddress),
+        }, nil
     }
-    content, err := ioutil.ReadFile(WalletFilename)
+    content, err := ioutil.ReadFile(walletPath())
     if err != nil {
         fmt.Printf("读取文件失败, err: %v\n", err)
         return nil, err
     }
-    // 注册接口类型
-    gob.Register(elliptic.P256())
+    var file walletFile
     decoder := gob.NewDecoder(bytes.NewReader(content))
-    err = decoder.Decode(&wallets)
+    err = decoder.Decode(&file)
     if err != nil {
+        if isP256WalletFile(content) {
+            return nil, fmt.Errorf("钱包文件 %s 使用旧版本的 P256 密钥, 当前版本使用 secp256k1 密钥, 无法转换, 其中的资金也无法在当前版本中使用; 请备份后移走该文件, 再创建新钱包", walletPath())
+        }
         fmt.Printf("Wallet 反序列化失败, err: %v\n", err)
         return nil, err
     }
-    return &wallets, nil
+    if file.WalletMap == nil {
+        file.WalletMap = make(map[string]*WalletKeyPair)
+    }
+    if file.WatchOnly == nil {
+        file.WatchOnly = make(map[string]*WatchOnlyAddress)
+    }
+    if file.MultiSig == nil {
+        file.MultiSig = make(map[string]*MultiSigAddress)
+    }
+    if file.HDChain != nil && file.HDChain.Addresses == nil {
+        file.HDChain.Addresses = make(map[string]uint32)
+    }
+    return &Wallets{
+        WalletMap:  file.WalletMap,
+        WatchOnly:  file.WatchOnly,
+        MultiSig:   file.MultiSig,
+        encryption: file.Encryption,
+        hdChain:    file.HDChain,
+    }, nil
 }
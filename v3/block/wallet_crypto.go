@@ -0,0 +1,149 @@
+package block
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/gob"
+    "fmt"
+    "golang.org/x/crypto/scrypt"
+    "io"
+    "log"
+    "os"
+    "strings"
+)
+
+// 钱包加密
+// 使用 scrypt 从密码派生出 32 字节的密钥，再用 AES-GCM 加密所有私钥
+// 地址和公钥不加密，查看地址时不需要输入密码
+
+// 钱包密码的环境变量，没有设置时从标准输入读取
+const PassphraseEnv = "WALLET_PASSPHRASE"
+
+// 修改密码时新密码的环境变量
+const NewPassphraseEnv = "WALLET_NEW_PASSPHRASE"
+
+// scrypt 参数
+const scryptN = 1 << 15
+const scryptR = 8
+const scryptP = 1
+const walletKeyLen = 32
+const walletSaltLen = 16
+
+// 加密后的私钥
+type WalletEncryption struct {
+    Salt       []byte // scrypt 盐
+    N          int    // scrypt 参数
+    R          int
+    P          int
+    Nonce      []byte // AES-GCM 随机数
+    Ciphertext []byte // 加密后的私钥，明文为 地址 => 私钥 的 gob 编码
+}
+
+// 使用密码派生密钥
+func (encryption *WalletEncryption) deriveKey(passphrase string) ([]byte, error) {
+    return scrypt.Key([]byte(passphrase), encryption.Salt, encryption.N, encryption.R, encryption.P, walletKeyLen)
+}
+
+// 创建新的加密参数，每次设置密码时使用新的盐
+func newWalletEncryption() *WalletEncryption {
+    salt := make([]byte, walletSaltLen)
+    _, err := io.ReadFull(rand.Reader, salt)
+    if err != nil {
+        log.Panic(err)
+    }
+    return &WalletEncryption{Salt: salt, N: scryptN, R: scryptR, P: scryptP}
+}
+
+// 加密私钥
+func (encryption *WalletEncryption) seal(key []byte, privateKeys map[string][]byte) error {
+    var buffer bytes.Buffer
+    encoder := gob.NewEncoder(&buffer)
+    err := encoder.Encode(privateKeys)
+    if err != nil {
+        return err
+    }
+
+    gcm, err := newGCM(key)
+    if err != nil {
+        return err
+    }
+    nonce := make([]byte, gcm.NonceSize())
+    _, err = io.ReadFull(rand.Reader, nonce)
+    if err != nil {
+        return err
+    }
+    encryption.Nonce = nonce
+    encryption.Ciphertext = gcm.Seal(nil, nonce, buffer.Bytes(), nil)
+    return nil
+}
+
+// 解密私钥，密钥错误时返回错误
+func (encryption *WalletEncryption) open(key []byte) (map[string][]byte, error) {
+    gcm, err := newGCM(key)
+    if err != nil {
+        return nil, err
+    }
+    plaintext, err := gcm.Open(nil, encryption.Nonce, encryption.Ciphertext, nil)
+    if err != nil {
+        return nil, fmt.Errorf("密码错误")
+    }
+
+    privateKeys := make(map[string][]byte)
+    decoder := gob.NewDecoder(bytes.NewReader(plaintext))
+    err = decoder.Decode(&privateKeys)
+    if err != nil {
+        return nil, err
+    }
+    return privateKeys, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// 从标准输入读取，多次读取时共用缓冲区
+var stdinReader = bufio.NewReader(os.Stdin)
+
+func readLine(prompt string) string {
+    fmt.Print(prompt)
+    line, _ := stdinReader.ReadString('\n')
+    return strings.TrimRight(line, "\r\n")
+}
+
+// 读取钱包密码
+// 优先使用环境变量 WALLET_PASSPHRASE，否则从标准输入读取一行
+func ReadPassphrase(prompt string) string {
+    if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+        return passphrase
+    }
+    return readLine(prompt)
+}
+
+// 读取确认，输入 y 或 yes 时返回 true
+func ReadConfirm(prompt string) bool {
+    answer := strings.ToLower(strings.TrimSpace(readLine(prompt + " [y/N]: ")))
+    return answer == "y" || answer == "yes"
+}
+
+// 读取新的钱包密码
+// 优先使用环境变量 env，否则从标准输入读取两次并确认一致
+func ReadNewPassphrase(env string) (string, error) {
+    passphrase := os.Getenv(env)
+    if passphrase == "" {
+        passphrase = readLine("请输入新密码: ")
+        if readLine("请再次输入新密码: ") != passphrase {
+            return "", fmt.Errorf("两次输入的密码不一致")
+        }
+    }
+    if passphrase == "" {
+        return "", fmt.Errorf("密码不能为空")
+    }
+    return passphrase, nil
+}
@@ -0,0 +1,292 @@
+package block
+
+import (
+    "crypto/hmac"
+    "crypto/sha512"
+    "encoding/binary"
+    "fmt"
+    "github.com/decred/dcrd/dcrec/secp256k1/v4"
+    "github.com/tyler-smith/go-bip39"
+    "strings"
+)
+
+// 分层确定性钱包（HD 钱包）
+// 使用 BIP39 助记词生成种子，按照 BIP32 从种子派生密钥，路径为 BIP44 的 m/44'/0'/0'/0/i
+// 只需要备份一次助记词，就可以恢复所有派生的地址
+
+// 助记词的熵长度，128 位对应 12 个单词
+const MnemonicEntropyBits = 128
+
+// 从该索引开始为强化派生
+const HardenedKeyStart = 0x80000000
+
+// BIP44 路径 m/44'/0'/0'/0
+const hdPurpose = 44
+const hdCoinType = 0
+const hdAccount = 0
+const hdExternalChain = 0
+
+// 恢复钱包时，连续这么多个地址没有在链上使用过就停止扫描
+const GapLimit = 20
+
+// 加密钱包时，助记词和私钥一起加密，使用该 key 保存
+const hdMnemonicKey = "hd_mnemonic"
+
+// HD 钱包的助记词和派生状态
+type HDChain struct {
+    Mnemonic  string            // 助记词，钱包加密后保存在加密的私钥中
+    NextIndex uint32            // 下一个派生地址的索引
+    Addresses map[string]uint32 // 派生的地址 => 索引
+}
+
+// BIP32 扩展私钥
+type hdKey struct {
+    privateKey *secp256k1.PrivateKey
+    chainCode  []byte
+}
+
+// 生成新的助记词
+func NewMnemonic() (string, error) {
+    entropy, err := bip39.NewEntropy(MnemonicEntropyBits)
+    if err != nil {
+        return "", err
+    }
+    return bip39.NewMnemonic(entropy)
+}
+
+// 使用助记词创建 HD 钱包，助记词的单词或校验和错误时返回错误
+func newHDChain(mnemonic string) (*HDChain, error) {
+    mnemonic = strings.Join(strings.Fields(mnemonic), " ")
+    if !bip39.IsMnemonicValid(mnemonic) {
+        return nil, fmt.Errorf("助记词无效")
+    }
+    return &HDChain{Mnemonic: mnemonic, Addresses: make(map[string]uint32)}, nil
+}
+
+// 从种子生成主密钥
+func newMasterKey(seed []byte) (*hdKey, error) {
+    mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+    mac.Write(seed)
+    sum := mac.Sum(nil)
+
+    var key secp256k1.ModNScalar
+    if key.SetByteSlice(sum[:32]) || key.IsZero() {
+        return nil, fmt.Errorf("种子无法生成主密钥")
+    }
+    return &hdKey{secp256k1.NewPrivateKey(&key), sum[32:]}, nil
+}
+
+// 派生子私钥
+// 索引不小于 HardenedKeyStart 时为强化派生，使用父私钥；否则使用父公钥
+func (key *hdKey) deriveChild(index uint32) (*hdKey, error) {
+    var data []byte
+    if index >= HardenedKeyStart {
+        data = append([]byte{0x00}, privateKeyToBytes(key.privateKey)...)
+    } else {
+        data = key.privateKey.PubKey().SerializeCompressed()
+    }
+    indexBytes := make([]byte, 4)
+    binary.BigEndian.PutUint32(indexBytes, index)
+    data = append(data, indexBytes...)
+
+    mac := hmac.New(sha512.New, key.chainCode)
+    mac.Write(data)
+    sum := mac.Sum(nil)
+
+    // 子私钥 = IL + 父私钥 (mod n)，IL 不小于 n 或结果为 0 时该索引无效
+    var childKey secp256k1.ModNScalar
+    if childKey.SetByteSlice(sum[:32]) {
+        return nil, fmt.Errorf("索引 %d 无法派生密钥", index)
+    }
+    childKey.Add(&key.privateKey.Key)
+    if childKey.IsZero() {
+        return nil, fmt.Errorf("索引 %d 无法派生密钥", index)
+    }
+    return &hdKey{secp256k1.NewPrivateKey(&childKey), sum[32:]}, nil
+}
+
+// 派生外部链 m/44'/0'/0'/0 的扩展私钥
+func (chain *HDChain) externalKey() (*hdKey, error) {
+    seed, err := bip39.NewSeedWithErrorChecking(chain.Mnemonic, "")
+    if err != nil {
+        return nil, err
+    }
+    key, err := newMasterKey(seed)
+    if err != nil {
+        return nil, err
+    }
+    path := []uint32{
+        HardenedKeyStart + hdPurpose,
+        HardenedKeyStart + hdCoinType,
+        HardenedKeyStart + hdAccount,
+        hdExternalChain,
+    }
+    for _, index := range path {
+        key, err = key.deriveChild(index)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return key, nil
+}
+
+// 派生索引为 index 的密钥对
+func deriveKeyPair(external *hdKey, index uint32) (*WalletKeyPair, error) {
+    key, err := external.deriveChild(index)
+    if err != nil {
+        return nil, err
+    }
+    return &WalletKeyPair{key.privateKey, key.privateKey.PubKey().SerializeCompressed()}, nil
+}
+
+// 获取派生路径
+func HDPath(index uint32) string {
+    return fmt.Sprintf("m/%d'/%d'/%d'/%d/%d", hdPurpose, hdCoinType, hdAccount, hdExternalChain, index)
+}
+
+// 钱包是否有助记词
+func (wallets *Wallets) HasHDChain() bool {
+    return wallets.hdChain != nil
+}
+
+// 为钱包生成助记词并保存，返回生成的助记词
+func (wallets *Wallets) NewHDChain() (string, error) {
+    if wallets.HasHDChain() {
+        return "", fmt.Errorf("钱包已有助记词")
+    }
+    if wallets.IsLocked() {
+        return "", fmt.Errorf("钱包已加密, 请先解锁")
+    }
+    mnemonic, err := NewMnemonic()
+    if err != nil {
+        return "", err
+    }
+    chain, err := newHDChain(mnemonic)
+    if err != nil {
+        return "", err
+    }
+    wallets.hdChain = chain
+    err = saveToFile(wallets)
+    if err != nil {
+        return "", err
+    }
+    return mnemonic, nil
+}
+
+// 获取钱包的助记词
+func (wallets *Wallets) Mnemonic() (string, error) {
+    if !wallets.HasHDChain() {
+        return "", fmt.Errorf("钱包没有助记词")
+    }
+    if wallets.IsLocked() {
+        return "", fmt.Errorf("钱包已加密, 请先解锁")
+    }
+    return wallets.hdChain.Mnemonic, nil
+}
+
+// 获取地址的派生路径，不是派生的地址时返回空字符串
+func (wallets *Wallets) HDPath(address string) string {
+    if !wallets.HasHDChain() {
+        return ""
+    }
+    index, ok := wallets.hdChain.Addresses[address]
+    if !ok {
+        return ""
+    }
+    return HDPath(index)
+}
+
+// 派生下一个地址，加入钱包
+func (wallets *Wallets) nextHDAddress() (string, error) {
+    chain := wallets.hdChain
+    external, err := chain.externalKey()
+    if err != nil {
+        return "", err
+    }
+    for ; chain.NextIndex < HardenedKeyStart ; chain.NextIndex++ {
+        walletKeyPair, err := deriveKeyPair(external, chain.NextIndex)
+        if err != nil {
+            // 极小概率的无效索引，跳过
+            fmt.Printf("%v, 跳过\n", err)
+            continue
+        }
+        address := walletKeyPair.GetAddress()
+        wallets.addKeyPair(address, walletKeyPair)
+        chain.Addresses[address] = chain.NextIndex
+        chain.NextIndex++
+        return address, nil
+    }
+    return "", fmt.Errorf("派生地址已用完")
+}
+
+// 使用助记词恢复钱包
+// 依次派生地址并检查是否在链上使用过，连续 GapLimit 个地址没有使用时停止
+// used 为链上所有出现过的公钥哈希，返回恢复的地址数
+func (wallets *Wallets) RestoreHDChain(mnemonic string, used map[string]bool) (int, error) {
+    if wallets.IsLocked() {
+        return 0, fmt.Errorf("钱包已加密, 请先解锁")
+    }
+    chain, err := newHDChain(mnemonic)
+    if err != nil {
+        return 0, err
+    }
+    if wallets.HasHDChain() {
+        if wallets.hdChain.Mnemonic != chain.Mnemonic {
+            return 0, fmt.Errorf("钱包已有其他助记词")
+        }
+        chain = wallets.hdChain
+    }
+    external, err := chain.externalKey()
+    if err != nil {
+        return 0, err
+    }
+
+    var keyPairs []*WalletKeyPair
+    var indexes []uint32
+    lastUsed := -1
+    gap := 0
+    for index := uint32(0) ; gap < GapLimit && index < HardenedKeyStart ; index++ {
+        walletKeyPair, err := deriveKeyPair(external, index)
+        if err != nil {
+            continue
+        }
+        keyPairs = append(keyPairs, walletKeyPair)
+        indexes = append(indexes, index)
+        if used[string(HashPublicKey(walletKeyPair.PublicKey))] {
+            lastUsed = len(keyPairs) - 1
+            gap = 0
+        } else {
+            gap++
+        }
+    }
+
+    // 保存最后一个使用过的地址及之前的所有地址
+    for i := 0 ; i <= lastUsed ; i++ {
+        address := keyPairs[i].GetAddress()
+        wallets.addKeyPair(address, keyPairs[i])
+        chain.Addresses[address] = indexes[i]
+    }
+    if lastUsed >= 0 && indexes[lastUsed] + 1 > chain.NextIndex {
+        chain.NextIndex = indexes[lastUsed] + 1
+    }
+    wallets.hdChain = chain
+    err = saveToFile(wallets)
+    if err != nil {
+        return 0, err
+    }
+    return lastUsed + 1, nil
+}
+
+// 获取主链上所有交易输出中出现过的公钥哈希
+func (blockChain *BlockChain) UsedPublicKeyHashes() map[string]bool {
+    used := make(map[string]bool)
+    it := blockChain.Iterator()
+    for block := it.Next() ; block != nil ; block = it.Next() {
+        for _, tx := range block.Transactions {
+            for _, output := range tx.TxOutputs {
+                used[string(output.LockedHash())] = true
+            }
+        }
+    }
+    return used
+}
@@ -2,51 +2,126 @@ package block
 
 import (
     "bytes"
-    "crypto/ecdsa"
-    "crypto/elliptic"
-    "crypto/rand"
     "crypto/sha256"
     "encoding/gob"
+    "fmt"
     "github.com/btcsuite/btcutil/base58"
+    "github.com/decred/dcrd/dcrec/secp256k1/v4"
+    "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
     "golang.org/x/crypto/ripemd160"
     "log"
+    "math/big"
 )
 
 // 创建密钥对，保存私钥和公钥
+// 使用与比特币相同的 secp256k1 曲线
 type WalletKeyPair struct {
-    PrivateKey *ecdsa.PrivateKey
-    PublicKey []byte // 使用 gob 编码序列化的公钥
+    PrivateKey *secp256k1.PrivateKey
+    PublicKey  []byte // 33 字节的压缩格式（SEC）公钥
+}
+
+// 钱包文件中保存的密钥对，私钥为 32 字节
+type walletKeyPairData struct {
+    PrivateKey []byte
+    PublicKey  []byte
 }
 
 func NewWalletKeyPair() *WalletKeyPair {
-    privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    privateKey, err := secp256k1.GeneratePrivateKey()
     if err != nil {
         log.Panic(err)
     }
+    return &WalletKeyPair{privateKey, privateKey.PubKey().SerializeCompressed()}
+}
 
-    publicKey := privateKey.PublicKey
-
+// gob 序列化，私钥为空时只保存公钥
+func (walletKeyPair *WalletKeyPair) GobEncode() ([]byte, error) {
+    data := walletKeyPairData{PublicKey: walletKeyPair.PublicKey}
+    if walletKeyPair.PrivateKey != nil {
+        data.PrivateKey = privateKeyToBytes(walletKeyPair.PrivateKey)
+    }
     var buffer bytes.Buffer
-    gob.Register(elliptic.P256())
     encoder := gob.NewEncoder(&buffer)
-    err = encoder.Encode(publicKey)
+    err := encoder.Encode(data)
+    return buffer.Bytes(), err
+}
+
+// gob 反序列化
+func (walletKeyPair *WalletKeyPair) GobDecode(content []byte) error {
+    var data walletKeyPairData
+    decoder := gob.NewDecoder(bytes.NewReader(content))
+    err := decoder.Decode(&data)
     if err != nil {
-        log.Panic(err)
+        return err
     }
+    walletKeyPair.PublicKey = data.PublicKey
+    walletKeyPair.PrivateKey = nil
+    if data.PrivateKey != nil {
+        walletKeyPair.PrivateKey = privateKeyFromBytes(data.PrivateKey)
+    }
+    return nil
+}
+
+// 判断是否为使用 P256 密钥的旧版本钱包文件
+// 旧版本的密钥对直接使用 gob 编码 *ecdsa.PrivateKey，这里只解码私钥的 D，忽略包含曲线接口的公钥
+func isP256WalletFile(content []byte) bool {
+    type legacyWalletKeyPair struct {
+        PrivateKey *struct {
+            D *big.Int
+        }
+        PublicKey []byte
+    }
+    var file struct {
+        WalletMap map[string]*legacyWalletKeyPair
+    }
+    err := gob.NewDecoder(bytes.NewReader(content)).Decode(&file)
+    return err == nil && len(file.WalletMap) > 0
+}
+
+// 将私钥转换成 32 字节
+func privateKeyToBytes(privateKey *secp256k1.PrivateKey) []byte {
+    return privateKey.Serialize()
+}
 
-    return &WalletKeyPair{privateKey, buffer.Bytes()}
+// 从 32 字节恢复私钥
+func privateKeyFromBytes(data []byte) *secp256k1.PrivateKey {
+    return secp256k1.PrivKeyFromBytes(data)
+}
+
+// 校验签名
+// 公钥为 SEC 格式，签名为 DER 编码
+func verifySignature(publicKey, signature, hash []byte) bool {
+    pubKey, err := secp256k1.ParsePubKey(publicKey)
+    if err != nil {
+        fmt.Printf("解析公钥错误: %v\n", err)
+        return false
+    }
+    sig, err := ecdsa.ParseDERSignature(signature)
+    if err != nil {
+        fmt.Printf("解析签名错误: %v\n", err)
+        return false
+    }
+    return sig.Verify(hash, pubKey)
 }
 
 // 获取钱包地址
 func (walletKeyPair *WalletKeyPair) GetAddress() string {
-    var address string
     // 20 个字节
     publicKeyHash := HashPublicKey(walletKeyPair.PublicKey)
+    return PublicKeyHashToAddress(publicKeyHash)
+}
 
-    // 1 个字节
-    version := []byte{0x00}
+// 根据公钥哈希生成地址
+func PublicKeyHashToAddress(publicKeyHash []byte) string {
+    return encodeAddress(PublicKeyHashAddressVersion, publicKeyHash)
+}
+
+// 根据版本号和哈希生成地址
+// 版本号为 0x00 时是公钥哈希地址，为 0x05 时是脚本哈希地址
+func encodeAddress(version byte, hash []byte) string {
+    var address string
     // 21 个字节
-    payload := append(version, publicKeyHash...)
+    payload := append([]byte{version}, hash...)
 
     // 进行两次 sha256
     firstHash := sha256.Sum256(payload)
@@ -70,6 +145,13 @@ func HashPublicKey(publicKey []byte) []byte {
     return publicKeyHash
 }
 
+// 给定一个地址，获取版本号和哈希
+func decodeAddress(address string) (byte, []byte) {
+    // 25 个字节
+    b := base58.Decode(address)
+    return b[0], b[1:len(b)-4]
+}
+
 // 给定一个地址，反向推出公钥哈希
 func Lock(address string) []byte {
     // 25 个字节
@@ -0,0 +1,262 @@
+package block
+
+import (
+    "bytes"
+    "encoding/gob"
+    "encoding/hex"
+    "fmt"
+    "github.com/decred/dcrd/dcrec/secp256k1/v4"
+    "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// 多重签名地址
+// 赎回脚本为 M <公钥1> ... <公钥N> N OP_CHECKMULTISIG，地址为赎回脚本的 P2SH 地址
+// 花费时需要其中 M 个私钥签名，解锁脚本为 OP_0 <签名1> ... <签名M> <赎回脚本>
+// 交易先由一个持有人创建并签名，再交给其他持有人添加签名，签名足够后才能加入交易池
+
+// DER 编码的签名加上签名类型的最大长度，用于估算交易大小
+const maxSignatureSize = 73
+
+// 未压缩公钥的长度，用于估算交易大小
+const maxPublicKeySize = 65
+
+// 钱包中的多重签名地址，只保存赎回脚本
+type MultiSigAddress struct {
+    RedeemScript []byte
+}
+
+// 创建多重签名地址，公钥为 SEC 格式
+func NewMultiSigAddress(m int, publicKeys [][]byte) (*MultiSigAddress, error) {
+    for _, publicKey := range publicKeys {
+        if _, err := secp256k1.ParsePubKey(publicKey); err != nil {
+            return nil, fmt.Errorf("公钥 %x 无效: %v", publicKey, err)
+        }
+    }
+    redeemScript, err := MultiSigScript(m, publicKeys)
+    if err != nil {
+        return nil, err
+    }
+    // 赎回脚本作为一个数据压入栈
+    if len(redeemScript) > maxPushSize {
+        return nil, fmt.Errorf("赎回脚本长度 %d 超过上限 %d", len(redeemScript), maxPushSize)
+    }
+    return &MultiSigAddress{redeemScript}, nil
+}
+
+// 获取多重签名地址
+func (multiSig *MultiSigAddress) Address() string {
+    return encodeAddress(ScriptHashAddressVersion, HashPublicKey(multiSig.RedeemScript))
+}
+
+// 获取需要的签名数和公钥数
+func (multiSig *MultiSigAddress) Required() (int, int) {
+    m, publicKeys, _ := extractMultiSig(multiSig.RedeemScript)
+    return m, len(publicKeys)
+}
+
+// 添加多重签名地址，keys 为十六进制公钥或钱包中的地址，返回添加的地址
+func (wallets *Wallets) AddMultiSig(m int, keys []string) (string, error) {
+    var publicKeys [][]byte
+    for _, key := range keys {
+        publicKey, err := wallets.publicKey(key)
+        if err != nil {
+            return "", err
+        }
+        publicKeys = append(publicKeys, publicKey)
+    }
+    multiSig, err := NewMultiSigAddress(m, publicKeys)
+    if err != nil {
+        return "", err
+    }
+    address := multiSig.Address()
+    if wallets.IsMultiSig(address) {
+        return address, fmt.Errorf("多重签名地址 %s 已在钱包中", address)
+    }
+    wallets.MultiSig[address] = multiSig
+    err = saveToFile(wallets)
+    if err != nil {
+        return "", err
+    }
+    return address, nil
+}
+
+// 获取公钥，参数为十六进制公钥，或者钱包中的地址和有公钥的只读地址
+func (wallets *Wallets) publicKey(addressOrPublicKey string) ([]byte, error) {
+    if data, err := hex.DecodeString(addressOrPublicKey); err == nil && (len(data) == 33 || len(data) == 65) {
+        return data, nil
+    }
+    if walletKeyPair, ok := wallets.WalletMap[addressOrPublicKey]; ok {
+        return walletKeyPair.PublicKey, nil
+    }
+    if watchOnly, ok := wallets.WatchOnly[addressOrPublicKey]; ok && watchOnly.PublicKey != nil {
+        return watchOnly.PublicKey, nil
+    }
+    return nil, fmt.Errorf("%s 不是公钥, 也不是钱包中已知公钥的地址", addressOrPublicKey)
+}
+
+// 获取地址的公钥
+func (wallets *Wallets) PublicKey(address string) ([]byte, error) {
+    if !IsValidAddress(address) {
+        return nil, fmt.Errorf("地址格式错误")
+    }
+    return wallets.publicKey(address)
+}
+
+// 判断地址是否为多重签名地址
+func (wallets *Wallets) IsMultiSig(address string) bool {
+    _, ok := wallets.MultiSig[address]
+    return ok
+}
+
+// 使用钱包中的私钥为交易的多重签名 input 添加签名，返回添加的签名数
+func (wallets *Wallets) SignMultiSig(tx *Transaction) (int, error) {
+    if wallets.IsLocked() {
+        return 0, fmt.Errorf("钱包已加密, 请先解锁")
+    }
+    count := 0
+    for _, walletKeyPair := range wallets.WalletMap {
+        for i := range tx.TxInputs {
+            if tx.signMultiSig(i, walletKeyPair.PrivateKey) {
+                count++
+            }
+        }
+    }
+    return count, nil
+}
+
+// 多重签名 input 的解锁脚本模板，只有赎回脚本，没有签名
+func multiSigScriptSig(redeemScript []byte) []byte {
+    return pushData([]byte{Op0}, redeemScript)
+}
+
+// 获取多重签名 input 的赎回脚本，解锁脚本为 OP_0 <签名>... <赎回脚本>，不是时返回空
+func (input *TxInput) multiSigRedeemScript() []byte {
+    ops, err := parseScript(input.ScriptSig)
+    if err != nil || len(ops) < 2 || ops[0].opcode != Op0 {
+        return nil
+    }
+    redeemScript := ops[len(ops)-1].data
+    if _, _, ok := extractMultiSig(redeemScript); !ok {
+        return nil
+    }
+    return redeemScript
+}
+
+// 获取多重签名 input 中有效的签名，按照公钥的顺序，没有签名的公钥为空
+func (tx *Transaction) multiSigSignatures(index int, redeemScript []byte) [][]byte {
+    _, publicKeys, _ := extractMultiSig(redeemScript)
+    signatures := make([][]byte, len(publicKeys))
+    ops, _ := parseScript(tx.TxInputs[index].ScriptSig)
+    signData := tx.SigHash(index, redeemScript)
+    for _, op := range ops[1:len(ops)-1] {
+        for j, publicKey := range publicKeys {
+            if signatures[j] == nil && verifyScriptSignature(publicKey, op.data, signData) {
+                signatures[j] = op.data
+                break
+            }
+        }
+    }
+    return signatures
+}
+
+// 使用私钥为多重签名 input 添加签名，私钥不在赎回脚本中或已经签名时返回 false
+// 签名按照公钥的顺序排列，最多保留需要的签名数
+func (tx *Transaction) signMultiSig(index int, privateKey *secp256k1.PrivateKey) bool {
+    redeemScript := tx.TxInputs[index].multiSigRedeemScript()
+    if redeemScript == nil || privateKey == nil {
+        return false
+    }
+    m, publicKeys, _ := extractMultiSig(redeemScript)
+    signatures := tx.multiSigSignatures(index, redeemScript)
+    if countSignatures(signatures) >= m {
+        return false
+    }
+    compressed := privateKey.PubKey().SerializeCompressed()
+    uncompressed := privateKey.PubKey().SerializeUncompressed()
+    signed := false
+    for j, publicKey := range publicKeys {
+        if signatures[j] != nil || (!bytes.Equal(publicKey, compressed) && !bytes.Equal(publicKey, uncompressed)) {
+            continue
+        }
+        signData := tx.SigHash(index, redeemScript)
+        fmt.Printf("对数据 %x 进行签名\n", signData)
+        signatures[j] = append(ecdsa.Sign(privateKey, signData).Serialize(), SigHashAll)
+        signed = true
+    }
+    if !signed {
+        return false
+    }
+
+    scriptSig := []byte{Op0}
+    for _, signature := range signatures {
+        if signature != nil && m > 0 {
+            scriptSig = pushData(scriptSig, signature)
+            m--
+        }
+    }
+    tx.TxInputs[index].ScriptSig = pushData(scriptSig, redeemScript)
+    return true
+}
+
+func countSignatures(signatures [][]byte) int {
+    count := 0
+    for _, signature := range signatures {
+        if signature != nil {
+            count++
+        }
+    }
+    return count
+}
+
+// 获取交易还需要的签名数
+// 多重签名 input 需要的签名数减去已有的有效签名数，其他 input 没有解锁脚本时需要 1 个签名
+func (tx *Transaction) MissingSignatures() int {
+    if tx.IsCoinBase() || tx.Version == LegacyTxVersion {
+        return 0
+    }
+    missing := 0
+    for i, input := range tx.TxInputs {
+        if redeemScript := input.multiSigRedeemScript(); redeemScript != nil {
+            m, _, _ := extractMultiSig(redeemScript)
+            if signed := countSignatures(tx.multiSigSignatures(i, redeemScript)); signed < m {
+                missing += m - signed
+            }
+            continue
+        }
+        if input.ScriptSig == nil {
+            missing++
+        }
+    }
+    return missing
+}
+
+// 交易签名完成后的估算大小，用于按照手续费率计算手续费
+// 缺少的多重签名按照最长的签名估算，没有签名的 P2PKH input 再加上最长的公钥
+func (tx *Transaction) EstimatedSize() int64 {
+    size := len(tx.ToBytes()) + tx.MissingSignatures() * (maxSignatureSize + 1)
+    for _, input := range tx.TxInputs {
+        if input.ScriptSig == nil && !tx.IsCoinBase() {
+            size += maxPublicKeySize + 1
+        }
+    }
+    return int64(size)
+}
+
+// 将交易编码成十六进制，用于在持有人之间传递部分签名的交易
+func (tx *Transaction) ToHex() string {
+    return hex.EncodeToString(tx.ToBytes())
+}
+
+// 解码十六进制的交易
+func NewTransactionFromHex(str string) (*Transaction, error) {
+    data, err := hex.DecodeString(str)
+    if err != nil {
+        return nil, fmt.Errorf("交易格式错误")
+    }
+    tx := &Transaction{}
+    err = gob.NewDecoder(bytes.NewReader(data)).Decode(tx)
+    if err != nil {
+        return nil, fmt.Errorf("交易格式错误: %v", err)
+    }
+    return tx, nil
+}
@@ -0,0 +1,50 @@
+package block
+
+import (
+    "encoding/hex"
+    "fmt"
+    "github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// 只读地址
+// 私钥保存在其他地方，钱包中只保存地址或公钥，用于查看余额和收款记录，不能用于付款
+type WatchOnlyAddress struct {
+    PublicKey []byte // 公钥，只添加地址时为空
+}
+
+// 添加只读地址，参数为地址或十六进制的 SEC 格式公钥，返回添加的地址
+func (wallets *Wallets) AddWatchOnly(addressOrPublicKey string) (string, error) {
+    var address string
+    var publicKey []byte
+    if data, err := hex.DecodeString(addressOrPublicKey); err == nil && (len(data) == 33 || len(data) == 65) {
+        if _, err := secp256k1.ParsePubKey(data); err != nil {
+            return "", fmt.Errorf("公钥无效: %v", err)
+        }
+        publicKey = data
+        address = (&WalletKeyPair{PublicKey: publicKey}).GetAddress()
+    } else {
+        if !IsValidAddress(addressOrPublicKey) {
+            return "", fmt.Errorf("地址格式错误")
+        }
+        address = addressOrPublicKey
+    }
+
+    if _, ok := wallets.WalletMap[address]; ok {
+        return address, fmt.Errorf("地址 %s 已在钱包中", address)
+    }
+    if watchOnly, ok := wallets.WatchOnly[address]; ok && (publicKey == nil || watchOnly.PublicKey != nil) {
+        return address, fmt.Errorf("只读地址 %s 已在钱包中", address)
+    }
+    wallets.WatchOnly[address] = &WatchOnlyAddress{publicKey}
+    err := saveToFile(wallets)
+    if err != nil {
+        return "", err
+    }
+    return address, nil
+}
+
+// 判断地址是否为只读地址
+func (wallets *Wallets) IsWatchOnly(address string) bool {
+    _, ok := wallets.WatchOnly[address]
+    return ok
+}
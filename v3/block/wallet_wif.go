@@ -0,0 +1,127 @@
+package block
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/btcsuite/btcutil/base58"
+    "github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// 私钥的导入导出格式 WIF（Wallet Import Format）
+// Base58Check(0x80 + 32 字节私钥 [+ 0x01])，末尾有 0x01 时对应压缩格式的公钥
+
+// WIF 的版本号
+const WIFVersion = 0x80
+
+// 压缩格式公钥的标记
+const wifCompressedFlag = 0x01
+
+// 将私钥转换成 WIF 格式
+func (walletKeyPair *WalletKeyPair) ToWIF() string {
+    payload := privateKeyToBytes(walletKeyPair.PrivateKey)
+    if len(walletKeyPair.PublicKey) == 33 {
+        payload = append(payload, wifCompressedFlag)
+    }
+    return base58.CheckEncode(payload, WIFVersion)
+}
+
+// 从 WIF 格式的私钥创建密钥对，校验和或格式错误时返回错误
+func NewWalletKeyPairFromWIF(wif string) (*WalletKeyPair, error) {
+    payload, version, err := base58.CheckDecode(wif)
+    if err == base58.ErrChecksum {
+        return nil, fmt.Errorf("WIF 校验和错误")
+    }
+    if err != nil {
+        return nil, fmt.Errorf("WIF 格式错误")
+    }
+    if version != WIFVersion {
+        return nil, fmt.Errorf("WIF 版本号错误: %#x", version)
+    }
+
+    compressed := false
+    switch {
+        case len(payload) == 33 && payload[32] == wifCompressedFlag:
+            compressed = true
+        case len(payload) == 32:
+        default:
+            return nil, fmt.Errorf("WIF 长度错误")
+    }
+
+    // 私钥必须在 1 到 n-1 之间
+    var key secp256k1.ModNScalar
+    if key.SetByteSlice(payload[:32]) || key.IsZero() {
+        return nil, fmt.Errorf("私钥无效")
+    }
+    privateKey := secp256k1.NewPrivateKey(&key)
+    publicKey := privateKey.PubKey().SerializeUncompressed()
+    if compressed {
+        publicKey = privateKey.PubKey().SerializeCompressed()
+    }
+    return &WalletKeyPair{privateKey, publicKey}, nil
+}
+
+// 导出地址的私钥
+func (wallets *Wallets) ExportKey(address string) (string, error) {
+    walletKeyPair, ok := wallets.WalletMap[address]
+    if !ok {
+        return "", fmt.Errorf("钱包中没有地址 %s", address)
+    }
+    if wallets.IsLocked() {
+        return "", fmt.Errorf("钱包已加密, 请先解锁")
+    }
+    return walletKeyPair.ToWIF(), nil
+}
+
+// 导入 WIF 格式的私钥，返回私钥对应的地址
+func (wallets *Wallets) ImportKey(wif string) (string, error) {
+    if wallets.IsLocked() {
+        return "", fmt.Errorf("钱包已加密, 请先解锁")
+    }
+    walletKeyPair, err := NewWalletKeyPairFromWIF(wif)
+    if err != nil {
+        return "", err
+    }
+    address := walletKeyPair.GetAddress()
+    if _, ok := wallets.WalletMap[address]; ok {
+        return address, fmt.Errorf("地址 %s 已在钱包中", address)
+    }
+    wallets.addKeyPair(address, walletKeyPair)
+    err = saveToFile(wallets)
+    if err != nil {
+        return "", err
+    }
+    return address, nil
+}
+
+// 扫描主链，统计与公钥哈希相关的交易数
+// 交易的输出属于该公钥哈希，或者交易的输入使用了该公钥哈希对应的公钥
+func (blockChain *BlockChain) CountTransactions(publicKeyHash []byte) int {
+    count := 0
+    it := blockChain.Iterator()
+    for block := it.Next() ; block != nil ; block = it.Next() {
+        for _, tx := range block.Transactions {
+            if isRelatedTransaction(tx, publicKeyHash) {
+                count++
+            }
+        }
+    }
+    return count
+}
+
+// 判断交易是否与公钥哈希相关
+func isRelatedTransaction(tx *Transaction, publicKeyHash []byte) bool {
+    for _, output := range tx.TxOutputs {
+        if bytes.Equal(output.LockedHash(), publicKeyHash) {
+            return true
+        }
+    }
+    if tx.IsCoinBase() {
+        return false
+    }
+    for _, input := range tx.TxInputs {
+        if bytes.Equal(input.LockedHash(), publicKeyHash) {
+            return true
+        }
+    }
+    return false
+}